@@ -83,11 +83,15 @@ func (s *SyncMap[K, V]) update(k K, v V, del bool) (V, bool) {
 	if s.items == nil && del {
 		s.l.Unlock()
 		return v, false
-	} else if !del {
+	} else if s.items == nil {
 		s.items = map[K]V{}
 	}
 	oldv, found := s.items[k]
-	s.items[k] = v
+	if del {
+		delete(s.items, k)
+	} else {
+		s.items[k] = v
+	}
 	s.l.Unlock()
 	return oldv, found
 }
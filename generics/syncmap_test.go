@@ -0,0 +1,27 @@
+package generics
+
+import "testing"
+
+func TestSyncMap(t *testing.T) {
+	var m SyncMap[string, int]
+	if _, found := m.Delete("a"); found {
+		t.Fatal("Delete on an empty map should not find anything")
+	}
+	m.Put("a", 1)
+	m.Put("b", 2)
+	if old, found := m.Put("a", 3); !found || old != 1 {
+		t.Fatalf("Put should return the previous value, got %v %v", old, found)
+	}
+	if v, found := m.Get("b"); !found || v != 2 {
+		t.Fatalf("Put should keep the other keys, got %v %v", v, found)
+	}
+	if old, found := m.Delete("a"); !found || old != 3 {
+		t.Fatalf("Delete should return the removed value, got %v %v", old, found)
+	}
+	if _, found := m.Get("a"); found {
+		t.Fatal("Deleted keys should not be found")
+	}
+	if v, found := m.Get("b"); !found || v != 2 {
+		t.Fatalf("Delete should keep the other keys, got %v %v", v, found)
+	}
+}
@@ -0,0 +1,238 @@
+// Package actor implements the receive loop shared by most mailbox consumers:
+// take a message from an inbox, decode its payload, dispatch it to the handler
+// registered for its kind and send replies back to the sender.
+//
+// Payloads are encoded with msgpack, the kind of a message is stored in KindHeader.
+package actor
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"log/slog"
+	"runtime/debug"
+	"time"
+
+	"github.com/andrebq/mixtape/mailbox"
+	"github.com/google/uuid"
+	"github.com/vmihailenco/msgpack/v5"
+	"go.opentelemetry.io/otel"
+	"go.opentelemetry.io/otel/attribute"
+	"go.opentelemetry.io/otel/codes"
+	"go.opentelemetry.io/otel/trace"
+)
+
+// KindHeader identifies the type of the payload carried by a message
+const KindHeader = "Mailbox-Kind"
+
+const tracerName = "github.com/andrebq/mixtape/mailbox/actor"
+
+type (
+	// Actor takes messages sent to an address and dispatches them
+	// to the handlers registered with Handle
+	Actor struct {
+		addr        mailbox.Address
+		transport   mailbox.Transport
+		handlers    map[string]handler
+		supervision Supervision
+	}
+
+	// Supervision decides what happens when a handler panics or the transport fails.
+	//
+	// The message which caused the panic is dropped and the receive loop is restarted
+	// after Backoff, unless the actor already restarted MaxRestarts times within Window,
+	// in which case Run returns ErrTooManyRestarts. Transport errors restart the loop
+	// the same way, except mailbox.ErrRackClosed which stops the actor.
+	Supervision struct {
+		MaxRestarts int
+		Window      time.Duration
+		Backoff     time.Duration
+	}
+
+	// Option configures optional behaviour of an Actor
+	Option func(*Actor)
+
+	// Request is the message being handled
+	Request struct {
+		Message *mailbox.Message
+		actor   *Actor
+	}
+
+	handler func(ctx context.Context, req *Request) error
+
+	panicked struct {
+		value any
+		stack []byte
+	}
+)
+
+var (
+	ErrTooManyRestarts = errors.New("actor restarted too many times")
+	ErrUnknownKind     = errors.New("no handler for message kind")
+)
+
+// WithSupervision replaces the default policy, which allows 10 restarts
+// per minute with 100ms between them
+func WithSupervision(s Supervision) Option {
+	return func(a *Actor) {
+		a.supervision = s
+	}
+}
+
+// New returns an actor which takes messages sent to addr from t
+func New(t mailbox.Transport, addr mailbox.Address, opts ...Option) *Actor {
+	a := &Actor{
+		addr:      addr,
+		transport: t,
+		handlers:  map[string]handler{},
+		supervision: Supervision{
+			MaxRestarts: 10,
+			Window:      time.Minute,
+			Backoff:     time.Second / 10,
+		},
+	}
+	for _, o := range opts {
+		o(a)
+	}
+	return a
+}
+
+// Handle registers fn for messages of the given kind, their payload is decoded into T.
+//
+// Handlers must be registered before calling Run.
+func Handle[T any](a *Actor, kind string, fn func(ctx context.Context, req *Request, body T) error) {
+	a.handlers[kind] = func(ctx context.Context, req *Request) error {
+		var body T
+		if err := msgpack.Unmarshal(req.Message.Payload, &body); err != nil {
+			return fmt.Errorf("unable to decode payload of kind %q: %w", kind, err)
+		}
+		return fn(ctx, req, body)
+	}
+}
+
+// NewMessage returns a message from -> to carrying body encoded as the given kind
+func NewMessage(from, to mailbox.Address, kind string, body any) (*mailbox.Message, error) {
+	payload, err := msgpack.Marshal(body)
+	if err != nil {
+		return nil, err
+	}
+	return &mailbox.Message{
+		ID:      uuid.Must(uuid.NewRandom()),
+		From:    from,
+		To:      to,
+		Payload: payload,
+		Headers: map[string][]string{KindHeader: {kind}},
+		SentAt:  time.Now().Round(0),
+	}, nil
+}
+
+// Kind returns the kind of msg, or an empty string if it is not set
+func Kind(msg *mailbox.Message) string {
+	if v := msg.Headers[KindHeader]; len(v) > 0 {
+		return v[0]
+	}
+	return ""
+}
+
+// Reply sends body to the sender of the request, the reply can be
+// received with mailbox.Call
+func (r *Request) Reply(ctx context.Context, kind string, body any) error {
+	msg, err := NewMessage(r.actor.addr, r.Message.From, kind, body)
+	if err != nil {
+		return err
+	}
+	msg.ReplyTo = r.Message.ID
+	return r.actor.transport.Deliver(ctx, msg)
+}
+
+// Send delivers body to the given address, using the actor address as sender
+func (a *Actor) Send(ctx context.Context, to mailbox.Address, kind string, body any) error {
+	msg, err := NewMessage(a.addr, to, kind, body)
+	if err != nil {
+		return err
+	}
+	return a.transport.Deliver(ctx, msg)
+}
+
+// Run takes messages until ctx is cancelled, in which case it returns nil
+// after the current handler finishes.
+//
+// Handler errors are logged, handler panics and transport errors are handled
+// according to the Supervision policy.
+func (a *Actor) Run(ctx context.Context) error {
+	var restarts []time.Time
+	for {
+		err := a.receive(ctx)
+		if ctx.Err() != nil {
+			return nil
+		}
+		if errors.Is(err, mailbox.ErrRackClosed) {
+			return err
+		}
+		now := time.Now()
+		restarts = append(restarts, now)
+		for len(restarts) > 0 && now.Sub(restarts[0]) > a.supervision.Window {
+			restarts = restarts[1:]
+		}
+		if len(restarts) > a.supervision.MaxRestarts {
+			return fmt.Errorf("%w: %v", ErrTooManyRestarts, err)
+		}
+		var p *panicked
+		if errors.As(err, &p) {
+			slog.ErrorContext(ctx, "Actor handler panicked, restarting", "address", a.addr, "error", err, "stack", string(p.stack))
+		} else {
+			slog.ErrorContext(ctx, "Actor transport failed, restarting", "address", a.addr, "error", err)
+		}
+		select {
+		case <-ctx.Done():
+			return nil
+		case <-time.After(a.supervision.Backoff):
+		}
+	}
+}
+
+// receive runs the receive loop until ctx is cancelled, the transport fails
+// or a handler panics
+func (a *Actor) receive(ctx context.Context) (err error) {
+	defer func() {
+		if v := recover(); v != nil {
+			err = &panicked{value: v, stack: debug.Stack()}
+		}
+	}()
+	for {
+		msg, err := a.transport.TakeAddress(ctx, a.addr)
+		if err != nil {
+			return err
+		}
+		if msg == nil {
+			continue
+		}
+		if err := a.dispatch(ctx, msg); err != nil {
+			slog.ErrorContext(ctx, "Error handling message", "address", a.addr, "messageId", msg.ID, "kind", Kind(msg), "error", err)
+		}
+	}
+}
+
+// dispatch calls the handler for msg, replies and messages sent by the
+// handler continue the trace of msg
+func (a *Actor) dispatch(ctx context.Context, msg *mailbox.Message) (err error) {
+	ctx, span := otel.Tracer(tracerName).Start(mailbox.ExtractTraceContext(ctx, msg), "actor.handle",
+		trace.WithSpanKind(trace.SpanKindConsumer),
+		trace.WithAttributes(attribute.String("messaging.message.id", msg.ID.String()), attribute.String("actor.kind", Kind(msg))))
+	defer func() {
+		if err != nil {
+			span.RecordError(err)
+			span.SetStatus(codes.Error, err.Error())
+		}
+		span.End()
+	}()
+	h, found := a.handlers[Kind(msg)]
+	if !found {
+		return fmt.Errorf("%w: %q", ErrUnknownKind, Kind(msg))
+	}
+	return h(ctx, &Request{Message: msg, actor: a})
+}
+
+func (p *panicked) Error() string {
+	return fmt.Sprintf("handler panic: %v", p.value)
+}
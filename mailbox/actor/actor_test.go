@@ -0,0 +1,168 @@
+package actor_test
+
+import (
+	"context"
+	"errors"
+	"net/http/httptest"
+	"testing"
+	"time"
+
+	"github.com/andrebq/mixtape/mailbox"
+	"github.com/andrebq/mixtape/mailbox/actor"
+	"github.com/andrebq/mixtape/mailbox/api"
+	"github.com/google/uuid"
+	"github.com/vmihailenco/msgpack/v5"
+)
+
+type (
+	sum struct {
+		A, B int
+	}
+)
+
+func newAddress() mailbox.Address {
+	return mailbox.Address{Node: uuid.Must(uuid.NewRandom())}
+}
+
+func adder(t mailbox.Transport, addr mailbox.Address, opts ...actor.Option) *actor.Actor {
+	a := actor.New(t, addr, opts...)
+	actor.Handle(a, "sum", func(ctx context.Context, req *actor.Request, body sum) error {
+		return req.Reply(ctx, "result", body.A+body.B)
+	})
+	actor.Handle(a, "panic", func(ctx context.Context, req *actor.Request, body string) error {
+		panic(body)
+	})
+	return a
+}
+
+func call(ctx context.Context, t *testing.T, transport mailbox.Transport, to mailbox.Address, a, b int) int {
+	t.Helper()
+	msg, err := actor.NewMessage(newAddress(), to, "sum", sum{A: a, B: b})
+	if err != nil {
+		t.Fatal(err)
+	}
+	reply, err := mailbox.Call(ctx, transport, msg)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if kind := actor.Kind(reply); kind != "result" {
+		t.Fatalf("Unexpected reply kind %q", kind)
+	}
+	var out int
+	if err := msgpack.Unmarshal(reply.Payload, &out); err != nil {
+		t.Fatal(err)
+	}
+	return out
+}
+
+func TestActor(t *testing.T) {
+	rack := mailbox.NewRack()
+	defer rack.Close()
+	srv := httptest.NewServer(api.New(rack))
+	defer srv.Close()
+	ctx, cancel := context.WithTimeout(context.Background(), time.Second)
+	defer cancel()
+
+	for name, transport := range map[string]mailbox.Transport{
+		"Rack":   rack,
+		"Client": &api.Client{URL: srv.URL},
+	} {
+		t.Run(name, func(t *testing.T) {
+			addr := newAddress()
+			runCtx, stop := context.WithCancel(ctx)
+			done := make(chan error, 1)
+			go func() {
+				done <- adder(transport, addr, actor.WithSupervision(actor.Supervision{MaxRestarts: 1, Window: time.Minute})).Run(runCtx)
+			}()
+
+			if v := call(ctx, t, transport, addr, 1, 2); v != 3 {
+				t.Fatalf("Expecting 3 got %v", v)
+			}
+			boom, _ := actor.NewMessage(newAddress(), addr, "panic", "boom")
+			if err := transport.Deliver(ctx, boom); err != nil {
+				t.Fatal(err)
+			}
+			// the actor is restarted after the panic
+			if v := call(ctx, t, transport, addr, 2, 2); v != 4 {
+				t.Fatalf("Expecting 4 got %v", v)
+			}
+
+			stop()
+			if err := <-done; err != nil {
+				t.Fatalf("Run should stop cleanly, got %v", err)
+			}
+		})
+	}
+}
+
+func TestTooManyRestarts(t *testing.T) {
+	rack := mailbox.NewRack()
+	defer rack.Close()
+	ctx, cancel := context.WithTimeout(context.Background(), time.Second)
+	defer cancel()
+
+	addr := newAddress()
+	for range 2 {
+		boom, _ := actor.NewMessage(newAddress(), addr, "panic", "boom")
+		if err := rack.Deliver(ctx, boom); err != nil {
+			t.Fatal(err)
+		}
+	}
+	err := adder(rack, addr, actor.WithSupervision(actor.Supervision{MaxRestarts: 1, Window: time.Minute})).Run(ctx)
+	if !errors.Is(err, actor.ErrTooManyRestarts) {
+		t.Fatalf("Expecting ErrTooManyRestarts got %v", err)
+	}
+}
+
+// flakyTransport fails the first takes, then takes from the embedded transport
+type flakyTransport struct {
+	mailbox.Transport
+	failures int
+}
+
+func (f *flakyTransport) TakeAddress(ctx context.Context, addr mailbox.Address) (*mailbox.Message, error) {
+	if f.failures > 0 {
+		f.failures--
+		return nil, errors.New("connection refused")
+	}
+	return f.Transport.TakeAddress(ctx, addr)
+}
+
+func TestTransportErrors(t *testing.T) {
+	rack := mailbox.NewRack()
+	defer rack.Close()
+	ctx, cancel := context.WithTimeout(context.Background(), time.Second)
+	defer cancel()
+
+	t.Run("Restart", func(t *testing.T) {
+		addr := newAddress()
+		runCtx, stop := context.WithCancel(ctx)
+		done := make(chan error, 1)
+		go func() {
+			done <- adder(&flakyTransport{Transport: rack, failures: 2}, addr, actor.WithSupervision(actor.Supervision{MaxRestarts: 2, Window: time.Minute})).Run(runCtx)
+		}()
+		if v := call(ctx, t, rack, addr, 1, 2); v != 3 {
+			t.Fatalf("Expecting 3 got %v", v)
+		}
+		stop()
+		if err := <-done; err != nil {
+			t.Fatalf("Run should stop cleanly, got %v", err)
+		}
+	})
+
+	t.Run("TooManyRestarts", func(t *testing.T) {
+		err := adder(&flakyTransport{Transport: rack, failures: 3}, newAddress(), actor.WithSupervision(actor.Supervision{MaxRestarts: 2, Window: time.Minute})).Run(ctx)
+		if !errors.Is(err, actor.ErrTooManyRestarts) {
+			t.Fatalf("Expecting ErrTooManyRestarts got %v", err)
+		}
+	})
+
+	t.Run("RackClosed", func(t *testing.T) {
+		closed := mailbox.NewRack()
+		closed.Close()
+		err := adder(closed, newAddress()).Run(ctx)
+		if !errors.Is(err, mailbox.ErrRackClosed) {
+			t.Fatalf("Expecting ErrRackClosed got %v", err)
+		}
+	})
+}
@@ -0,0 +1,52 @@
+package api
+
+import (
+	"context"
+	"iter"
+	"net/http"
+
+	"github.com/andrebq/mixtape/mailbox"
+)
+
+type (
+	// Client talks to a rack exposed by New
+	Client struct {
+		HTTP *http.Client
+		URL  string
+		// Token is sent as a bearer token, if not empty
+		Token string
+	}
+)
+
+var (
+	_ mailbox.Remote    = (*Client)(nil)
+	_ mailbox.Transport = (*Client)(nil)
+)
+
+func (c *Client) Deliver(ctx context.Context, msg *mailbox.Message) error {
+	return Post(c.context(ctx), c.httpClient(), c.URL, msg)
+}
+
+// TakeAddress waits until a message for addr arrives, see mailbox.Rack.TakeAddress
+func (c *Client) TakeAddress(ctx context.Context, addr mailbox.Address) (*mailbox.Message, error) {
+	return GetAddress(c.context(ctx), c.httpClient(), c.URL, addr)
+}
+
+// Subscribe streams messages for addr, see Stream
+func (c *Client) Subscribe(ctx context.Context, addr mailbox.Address) iter.Seq2[*mailbox.Message, error] {
+	return Stream(c.context(ctx), c.httpClient(), c.URL, addr)
+}
+
+func (c *Client) context(ctx context.Context) context.Context {
+	if c.Token == "" {
+		return ctx
+	}
+	return WithToken(ctx, c.Token)
+}
+
+func (c *Client) httpClient() *http.Client {
+	if c.HTTP == nil {
+		return http.DefaultClient
+	}
+	return c.HTTP
+}
@@ -0,0 +1,101 @@
+package api
+
+import (
+	"encoding/json"
+	"errors"
+	"io"
+	"mime"
+	"strings"
+
+	"github.com/andrebq/mixtape/mailbox"
+	"github.com/tinylib/msgp/msgp"
+)
+
+const (
+	// MsgpackType is the default format, see https://www.iana.org/assignments/media-types/application/vnd.msgpack
+	MsgpackType = "application/vnd.msgpack"
+	// JSONType uses the JSON mapping described in mailbox.Message
+	JSONType = "application/json"
+)
+
+var (
+	errUnsupportedMediaType = errors.New("unsupported media type")
+	errNotAcceptable        = errors.New("none of the accepted media types is supported")
+)
+
+// requestType returns the format of a request body, an empty content type means msgpack
+func requestType(contentType string) (string, error) {
+	if contentType == "" {
+		return MsgpackType, nil
+	}
+	mt, _, err := mime.ParseMediaType(contentType)
+	if err != nil {
+		return "", errUnsupportedMediaType
+	}
+	switch mt {
+	case MsgpackType, JSONType:
+		return mt, nil
+	}
+	return "", errUnsupportedMediaType
+}
+
+// responseType picks the format of the response from the Accept header,
+// the first supported type wins and quality values are ignored.
+// Msgpack is used if the header is empty or accepts anything.
+func responseType(accept string) (string, error) {
+	if accept == "" {
+		return MsgpackType, nil
+	}
+	for _, part := range strings.Split(accept, ",") {
+		mt, _, err := mime.ParseMediaType(strings.TrimSpace(part))
+		if err != nil {
+			continue
+		}
+		switch mt {
+		case MsgpackType, JSONType:
+			return mt, nil
+		case "*/*", "application/*":
+			return MsgpackType, nil
+		}
+	}
+	return "", errNotAcceptable
+}
+
+func decodeMessage(mt string, r io.Reader, msg *mailbox.Message) error {
+	if mt == JSONType {
+		return json.NewDecoder(r).Decode(msg)
+	}
+	return msg.DecodeMsg(msgp.NewReader(r))
+}
+
+// appendValue encodes v at the end of buf, JSON values are followed
+// by a new line so they can be used in streams
+func appendValue(mt string, buf []byte, v msgp.Marshaler) ([]byte, error) {
+	if mt == JSONType {
+		out, err := json.Marshal(v)
+		if err != nil {
+			return buf, err
+		}
+		return append(append(buf, out...), '\n'), nil
+	}
+	return v.MarshalMsg(buf)
+}
+
+func appendBatch(mt string, buf []byte, msgs []*mailbox.Message) ([]byte, error) {
+	if mt == JSONType {
+		if msgs == nil {
+			msgs = []*mailbox.Message{}
+		}
+		out, err := json.Marshal(msgs)
+		return append(buf, out...), err
+	}
+	buf = msgp.AppendArrayHeader(buf, uint32(len(msgs)))
+	var err error
+	for _, msg := range msgs {
+		buf, err = msg.MarshalMsg(buf)
+		if err != nil {
+			return buf, err
+		}
+	}
+	return buf, nil
+}
@@ -0,0 +1,81 @@
+package api
+
+import (
+	"context"
+	"errors"
+	"math"
+	"net/http"
+	"strconv"
+
+	"github.com/andrebq/mixtape/mailbox"
+)
+
+type (
+	// ErrorKind groups the errors returned by the rack and by the token checks,
+	// the HTTP handler and the gRPC server (see mailbox/rpc) map each kind to
+	// their own status codes
+	ErrorKind uint8
+)
+
+const (
+	KindInternal ErrorKind = iota
+	KindInvalid
+	KindUnauthenticated
+	KindForbidden
+	KindNotFound
+	KindRateLimited
+	KindRackFull
+	KindUnavailable
+	KindCanceled
+)
+
+// Classify returns the kind of err
+func Classify(err error) ErrorKind {
+	switch {
+	case errors.Is(err, mailbox.ErrMissingSentAt), errors.Is(err, mailbox.ErrInvalidTTL),
+		errors.Is(err, mailbox.ErrInvalidDeliverAfter):
+		return KindInvalid
+	case errors.Is(err, ErrMissingToken), errors.Is(err, ErrInvalidToken), errors.Is(err, ErrTokenExpired):
+		return KindUnauthenticated
+	case errors.Is(err, ErrForbidden):
+		return KindForbidden
+	case errors.Is(err, mailbox.ErrLeaseNotFound), errors.Is(err, mailbox.ErrNotScheduled):
+		return KindNotFound
+	case errors.Is(err, mailbox.ErrRateLimited):
+		return KindRateLimited
+	case errors.Is(err, mailbox.ErrRackFull):
+		return KindRackFull
+	case errors.Is(err, mailbox.ErrRackClosed):
+		return KindUnavailable
+	case errors.Is(err, context.Canceled), errors.Is(err, context.DeadlineExceeded):
+		return KindCanceled
+	default:
+		return KindInternal
+	}
+}
+
+// writeError writes the response for err, callers should log internal errors
+// since their message is not sent to the client
+func writeError(w http.ResponseWriter, err error) {
+	switch Classify(err) {
+	case KindInvalid:
+		http.Error(w, err.Error(), http.StatusBadRequest)
+	case KindUnauthenticated:
+		w.Header().Set("WWW-Authenticate", "Bearer")
+		http.Error(w, err.Error(), http.StatusUnauthorized)
+	case KindForbidden:
+		http.Error(w, err.Error(), http.StatusForbidden)
+	case KindNotFound:
+		http.Error(w, err.Error(), http.StatusNotFound)
+	case KindRateLimited:
+		var limited *mailbox.RateLimitError
+		if errors.As(err, &limited) {
+			w.Header().Set("Retry-After", strconv.Itoa(int(math.Ceil(limited.RetryAfter.Seconds()))))
+		}
+		http.Error(w, err.Error(), http.StatusTooManyRequests)
+	case KindRackFull, KindUnavailable:
+		http.Error(w, err.Error(), http.StatusServiceUnavailable)
+	default:
+		http.Error(w, "Internal error", http.StatusInternalServerError)
+	}
+}
@@ -8,15 +8,87 @@ import (
 	"net/http"
 	"strconv"
 	"strings"
+	"time"
 
-	"github.com/andrebq/mixtape/generics"
 	"github.com/andrebq/mixtape/mailbox"
 	"github.com/google/uuid"
 	"github.com/tinylib/msgp/msgp"
+	"go.opentelemetry.io/otel"
+	"go.opentelemetry.io/otel/trace"
 )
 
-func New(rack *mailbox.Rack) http.Handler {
-	listeners := generics.SyncMap[uuid.UUID, int]{}
+const (
+	// LeaseHeader carries the lease of a message fetched with manual acknowledgement,
+	// batches contain one value per message
+	LeaseHeader = "Mailbox-Lease"
+
+	// MaxListeners is how many concurrent requests (including streams) can wait
+	// on the same inbox
+	MaxListeners = 5
+	// MaxBatch is the largest value accepted for ?max=
+	MaxBatch = 1000
+	// DefaultWait is how long a batch request waits for the first message
+	// when ?wait= is not provided
+	DefaultWait = 30 * time.Second
+)
+
+type (
+	// Option configures the handler returned by New
+	Option func(*config)
+
+	config struct {
+		tokenKey       []byte
+		tracerProvider trace.TracerProvider
+	}
+)
+
+// WithTokenKey requires every request to carry a token signed with key,
+// see SignToken
+func WithTokenKey(key []byte) Option {
+	return func(c *config) {
+		c.tokenKey = key
+	}
+}
+
+// New returns a handler exposing the rack over HTTP.
+//
+// POST /{id} delivers a message, senders which exceed their limits (see
+// mailbox.WithSenderLimits) get 429 with a Retry-After header. When tokens are
+// required, senders are identified by the token subject instead of From.Node.
+//
+// GET /{id} takes messages for any process of the node, while GET /{id}/{process}
+// follows the routing rules of mailbox.Rack.TakeAddress.
+//
+// With ?max=N the handler returns a msgpack array with up to N messages, waiting up to
+// ?wait= (a time.Duration, defaults to DefaultWait) for the first one. An empty array
+// is returned if no message arrives in time.
+//
+// GET /{id}/stream keeps the connection open and writes each message as it arrives,
+// see Stream.
+//
+// When a token key is configured (see WithTokenKey), every request must carry a bearer token
+// granting access to the inbox (see Capability). Requests which are not bound to an
+// inbox (/_log) only need the permission.
+//
+// Requests and responses use msgpack by default, JSON (see mailbox.Message for the mapping)
+// is selected with the Content-Type and Accept headers, streams use one JSON value per line.
+// Unsupported formats are rejected with 415 (request body) or 406 (response).
+//
+// GET /_log?from=<offset> streams the rack message log, see Tail.
+//
+// Messages are only removed from the rack after they were written to the client,
+// with ?ack=manual the handler returns the lease in the Mailbox-Lease header and
+// the client must acknowledge it with POST /{id}/ack, passing the lease in the
+// Mailbox-Lease header.
+//
+// DELETE /{id}/scheduled/{msgid} cancels a message which was posted to the inbox with
+// the mailbox.DeliverAfterHeader and is not visible yet, see Cancel.
+func New(rack *mailbox.Rack, opts ...Option) http.Handler {
+	cfg := &config{}
+	for _, o := range opts {
+		o(cfg)
+	}
+	listeners := &listenerLimit{max: MaxListeners}
 	mux := http.NewServeMux()
 	mux.HandleFunc("POST /{id}", func(w http.ResponseWriter, r *http.Request) {
 		inbox, err := uuid.Parse(r.PathValue("id"))
@@ -24,72 +96,199 @@ func New(rack *mailbox.Rack) http.Handler {
 			http.Error(w, err.Error(), http.StatusBadRequest)
 			return
 		}
+		mt, err := requestType(r.Header.Get("Content-Type"))
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusUnsupportedMediaType)
+			return
+		}
 		var msg mailbox.Message
-		err = msg.DecodeMsg(msgp.NewReader(r.Body))
+		err = decodeMessage(mt, r.Body, &msg)
 		if err != nil {
 			http.Error(w, err.Error(), http.StatusBadRequest)
 			return
 		}
-		err = rack.Deliver(r.Context(), &msg)
+		capability, ok := cfg.capability(w, r, msg.To.Node, PermWrite)
+		if !ok {
+			return
+		}
+		ctx, span := cfg.startPost(r.Context(), &msg)
+		err = rack.Deliver(WithSender(ctx, capability), &msg)
+		endSpan(span, err)
 		if err != nil {
-			// TODO handle internal errors here
-			slog.ErrorContext(r.Context(), "Error delivering message for inbox", "inbox", inbox, "error", err, "messageId", msg.ID, "ReplyTo", msg.ReplyTo)
-			http.Error(w, "Internal error", http.StatusInternalServerError)
+			if Classify(err) == KindInternal {
+				slog.ErrorContext(r.Context(), "Error delivering message for inbox", "inbox", inbox, "error", err, "messageId", msg.ID, "ReplyTo", msg.ReplyTo)
+			}
+			writeError(w, err)
 			return
 		}
 		w.WriteHeader(http.StatusOK)
 	})
-	mux.HandleFunc("GET /{id}", func(w http.ResponseWriter, r *http.Request) {
+	take := func(w http.ResponseWriter, r *http.Request) {
 		inbox, err := uuid.Parse(r.PathValue("id"))
 		if err != nil {
 			http.Error(w, err.Error(), http.StatusBadRequest)
 			return
 		}
-		var tooMany bool
-		listeners.Update(inbox, func(v int, present bool) (newval int, keep bool) {
-			if v == 5 {
-				tooMany = true
+		if !cfg.authorize(w, r, inbox, PermRead) {
+			return
+		}
+		var process uint64
+		if p := r.PathValue("process"); p != "" {
+			process, err = strconv.ParseUint(p, 10, 64)
+			if err != nil {
+				http.Error(w, err.Error(), http.StatusBadRequest)
+				return
 			}
-			return v + 1, true
-		})
-		if tooMany {
+		}
+		mt, err := responseType(r.Header.Get("Accept"))
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusNotAcceptable)
+			return
+		}
+		query := r.URL.Query()
+		manualAck := query.Get("ack") == "manual"
+		batch := query.Has("max")
+		max, wait := 1, DefaultWait
+		if batch {
+			max, err = strconv.Atoi(query.Get("max"))
+			if err != nil || max <= 0 || max > MaxBatch {
+				http.Error(w, fmt.Sprintf("max must be between 1 and %v", MaxBatch), http.StatusBadRequest)
+				return
+			}
+		}
+		if query.Has("wait") {
+			wait, err = time.ParseDuration(query.Get("wait"))
+			if err != nil {
+				http.Error(w, err.Error(), http.StatusBadRequest)
+				return
+			}
+		}
+		if !listeners.acquire(inbox) {
 			http.Error(w, "Too many listeners for the given inbox", http.StatusTooManyRequests)
 			return
 		}
-		msg, err := rack.Take(r.Context(), inbox)
-		listeners.Update(inbox, func(v int, present bool) (newval int, keep bool) {
-			v = v - 1
-			return v, v > 0
-		})
+		addr := mailbox.Address{Node: inbox, Process: process}
+		var msgs []*mailbox.Message
+		var leases []uuid.UUID
+		if batch {
+			msgs, leases, err = rack.TakeLeaseN(r.Context(), addr, max, wait)
+		} else {
+			var msg *mailbox.Message
+			var lease uuid.UUID
+			msg, lease, err = rack.TakeLease(r.Context(), addr)
+			msgs, leases = append(msgs, msg), append(leases, lease)
+		}
+		listeners.release(inbox)
 		if err != nil {
 			// TODO handle internal errors here
 			slog.ErrorContext(r.Context(), "Error fetching message for inbox", "inbox", inbox, "error", err)
 			http.Error(w, "Internal error", http.StatusInternalServerError)
 			return
 		}
-		// TODO: handle accept headers properly, for now, assume msgpack is acceptable
-		buf, err := msg.MarshalMsg(nil)
+		var buf []byte
+		if batch {
+			buf, err = appendBatch(mt, buf, msgs)
+		} else {
+			buf, err = appendValue(mt, buf, msgs[0])
+		}
 		if err != nil {
 			// TODO handle internal errors here
 			slog.ErrorContext(r.Context(), "Error encoding message for inbox", "inbox", inbox, "error", err)
 			http.Error(w, "Internal error", http.StatusInternalServerError)
 			return
 		}
-		w.Header().Add("Content-Type", "application/vnd.msgpack") // https://www.iana.org/assignments/media-types/application/vnd.msgpack
+		w.Header().Add("Content-Type", mt)
 		w.Header().Add("Content-Length", strconv.Itoa(len(buf)))
+		if manualAck {
+			for _, lease := range leases {
+				w.Header().Add(LeaseHeader, lease.String())
+			}
+		}
+		w.WriteHeader(http.StatusOK)
+		if _, err := w.Write(buf); err != nil {
+			// the lease will expire and the message will be delivered again
+			slog.WarnContext(r.Context(), "Error writing message for inbox", "inbox", inbox, "error", err)
+			return
+		}
+		if manualAck {
+			return
+		}
+		if err := http.NewResponseController(w).Flush(); err != nil {
+			slog.WarnContext(r.Context(), "Error flushing message for inbox", "inbox", inbox, "error", err)
+			return
+		}
+		for i, lease := range leases {
+			if err := rack.Ack(context.WithoutCancel(r.Context()), inbox, lease); err != nil {
+				slog.ErrorContext(r.Context(), "Error acknowledging message for inbox", "inbox", inbox, "error", err, "messageId", msgs[i].ID)
+			}
+		}
+	}
+	mux.HandleFunc("GET /{id}", take)
+	mux.HandleFunc("GET /{id}/{process}", take)
+	mux.HandleFunc("GET /{id}/stream", stream(rack, cfg, listeners))
+	mux.HandleFunc("GET /_log", tailLog(rack, cfg))
+	mux.HandleFunc("POST /{id}/ack", func(w http.ResponseWriter, r *http.Request) {
+		inbox, err := uuid.Parse(r.PathValue("id"))
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			return
+		}
+		lease, err := uuid.Parse(r.Header.Get(LeaseHeader))
+		if err != nil {
+			http.Error(w, "invalid lease header: "+err.Error(), http.StatusBadRequest)
+			return
+		}
+		if !cfg.authorize(w, r, inbox, PermRead) {
+			return
+		}
+		if err := rack.Ack(r.Context(), inbox, lease); err != nil {
+			if Classify(err) == KindInternal {
+				slog.ErrorContext(r.Context(), "Error acknowledging lease", "lease", lease, "error", err)
+			}
+			writeError(w, err)
+			return
+		}
+		w.WriteHeader(http.StatusOK)
+	})
+	mux.HandleFunc("DELETE /{id}/scheduled/{msgid}", func(w http.ResponseWriter, r *http.Request) {
+		inbox, err := uuid.Parse(r.PathValue("id"))
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			return
+		}
+		id, err := uuid.Parse(r.PathValue("msgid"))
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			return
+		}
+		if !cfg.authorize(w, r, inbox, PermWrite) {
+			return
+		}
+		if err := rack.Cancel(r.Context(), inbox, id); err != nil {
+			if Classify(err) == KindInternal {
+				slog.ErrorContext(r.Context(), "Error cancelling scheduled message", "messageId", id, "error", err)
+			}
+			writeError(w, err)
+			return
+		}
 		w.WriteHeader(http.StatusOK)
-		w.Write(buf)
 	})
 	return mux
 }
 
-func Post(ctx context.Context, cli *http.Client, urlPrefix string, msg *mailbox.Message) error {
+// Post delivers msg to the rack, the trace context of ctx is sent along
+// with the headers of msg, which are not modified (see mailbox.InjectTraceContext)
+func Post(ctx context.Context, cli *http.Client, urlPrefix string, msg *mailbox.Message) (err error) {
+	ctx, span := otel.Tracer(tracerName).Start(ctx, "mailbox.post", trace.WithSpanKind(trace.SpanKindClient))
+	defer func() { endSpan(span, err) }()
+	sent := *msg
+	mailbox.InjectTraceContext(ctx, &sent)
 	urlPrefix = strings.TrimSuffix(urlPrefix, "/")
-	buf, err := msg.MarshalMsg(nil)
+	buf, err := sent.MarshalMsg(nil)
 	if err != nil {
 		return err
 	}
-	req, err := http.NewRequestWithContext(ctx, "POST", fmt.Sprintf("%v/%v", urlPrefix, msg.To.Node), bytes.NewBuffer(buf))
+	req, err := newRequest(ctx, "POST", fmt.Sprintf("%v/%v", urlPrefix, msg.To.Node), bytes.NewBuffer(buf))
 	if err != nil {
 		return err
 	}
@@ -98,7 +297,10 @@ func Post(ctx context.Context, cli *http.Client, urlPrefix string, msg *mailbox.
 		return err
 	}
 	res.Body.Close()
-	if res.StatusCode != http.StatusOK {
+	if res.StatusCode == http.StatusTooManyRequests {
+		retry, _ := strconv.Atoi(res.Header.Get("Retry-After"))
+		return &mailbox.RateLimitError{Sender: msg.From.Node.String(), RetryAfter: time.Duration(retry) * time.Second}
+	} else if res.StatusCode != http.StatusOK {
 		return fmt.Errorf("unexpected status code: %v", res.StatusCode)
 	}
 	return nil
@@ -106,22 +308,142 @@ func Post(ctx context.Context, cli *http.Client, urlPrefix string, msg *mailbox.
 
 func Get(ctx context.Context, cli *http.Client, urlPrefix string, node uuid.UUID) (*mailbox.Message, error) {
 	urlPrefix = strings.TrimSuffix(urlPrefix, "/")
-	req, err := http.NewRequestWithContext(ctx, "GET", fmt.Sprintf("%v/%v", urlPrefix, node), nil)
+	msg, _, err := get(ctx, cli, fmt.Sprintf("%v/%v", urlPrefix, node))
+	return msg, err
+}
+
+// GetAddress is like Get but only takes messages which can be routed to addr,
+// see mailbox.Rack.TakeAddress
+func GetAddress(ctx context.Context, cli *http.Client, urlPrefix string, addr mailbox.Address) (*mailbox.Message, error) {
+	urlPrefix = strings.TrimSuffix(urlPrefix, "/")
+	msg, _, err := get(ctx, cli, fmt.Sprintf("%v/%v/%v", urlPrefix, addr.Node, addr.Process))
+	return msg, err
+}
+
+// TakeLease fetches a message which must be acknowledged with Ack,
+// otherwise the rack will deliver it again after the lease timeout
+func TakeLease(ctx context.Context, cli *http.Client, urlPrefix string, addr mailbox.Address) (*mailbox.Message, uuid.UUID, error) {
+	urlPrefix = strings.TrimSuffix(urlPrefix, "/")
+	msg, res, err := get(ctx, cli, fmt.Sprintf("%v/%v/%v?ack=manual", urlPrefix, addr.Node, addr.Process))
+	if err != nil {
+		return nil, uuid.Nil, err
+	}
+	lease, err := uuid.Parse(res.Header.Get(LeaseHeader))
+	if err != nil {
+		return nil, uuid.Nil, fmt.Errorf("invalid lease header: %w", err)
+	}
+	return msg, lease, nil
+}
+
+// GetN fetches up to max messages for addr, waiting up to wait for the first one,
+// see mailbox.Rack.TakeN
+func GetN(ctx context.Context, cli *http.Client, urlPrefix string, addr mailbox.Address, max int, wait time.Duration) ([]*mailbox.Message, error) {
+	urlPrefix = strings.TrimSuffix(urlPrefix, "/")
+	req, err := newRequest(ctx, "GET", fmt.Sprintf("%v/%v/%v?max=%v&wait=%v", urlPrefix, addr.Node, addr.Process, max, wait), nil)
 	if err != nil {
 		return nil, err
 	}
 	res, err := cli.Do(req)
 	if err != nil {
 		return nil, err
-	} else if res.StatusCode != http.StatusOK {
+	}
+	defer res.Body.Close()
+	if res.StatusCode != http.StatusOK {
 		return nil, fmt.Errorf("unexpected status code: %v", res.StatusCode)
 	}
+	rd := msgp.NewReader(res.Body)
+	sz, err := rd.ReadArrayHeader()
+	if err != nil {
+		return nil, err
+	} else if sz > MaxBatch {
+		return nil, fmt.Errorf("batch too large: %v", sz)
+	}
+	out := make([]*mailbox.Message, sz)
+	for i := range out {
+		out[i] = &mailbox.Message{}
+		if err := out[i].DecodeMsg(rd); err != nil {
+			return nil, err
+		}
+	}
+	return out, nil
+}
+
+// Ack removes a message taken from inbox with TakeLease,
+// see mailbox.Rack.Ack
+func Ack(ctx context.Context, cli *http.Client, urlPrefix string, inbox, lease uuid.UUID) error {
+	urlPrefix = strings.TrimSuffix(urlPrefix, "/")
+	req, err := newRequest(ctx, "POST", fmt.Sprintf("%v/%v/ack", urlPrefix, inbox), nil)
+	if err != nil {
+		return err
+	}
+	req.Header.Set(LeaseHeader, lease.String())
+	res, err := cli.Do(req)
+	if err != nil {
+		return err
+	}
+	res.Body.Close()
+	switch res.StatusCode {
+	case http.StatusOK:
+		return nil
+	case http.StatusNotFound:
+		return mailbox.ErrLeaseNotFound
+	default:
+		return fmt.Errorf("unexpected status code: %v", res.StatusCode)
+	}
+}
+
+// Cancel removes a scheduled message sent to inbox before it becomes visible,
+// see mailbox.Rack.Cancel
+func Cancel(ctx context.Context, cli *http.Client, urlPrefix string, inbox, id uuid.UUID) error {
+	urlPrefix = strings.TrimSuffix(urlPrefix, "/")
+	req, err := newRequest(ctx, "DELETE", fmt.Sprintf("%v/%v/scheduled/%v", urlPrefix, inbox, id), nil)
+	if err != nil {
+		return err
+	}
+	res, err := cli.Do(req)
+	if err != nil {
+		return err
+	}
+	res.Body.Close()
+	switch res.StatusCode {
+	case http.StatusOK:
+		return nil
+	case http.StatusNotFound:
+		return mailbox.ErrNotScheduled
+	default:
+		return fmt.Errorf("unexpected status code: %v", res.StatusCode)
+	}
+}
+
+func get(ctx context.Context, cli *http.Client, url string) (*mailbox.Message, *http.Response, error) {
+	req, err := newRequest(ctx, "GET", url, nil)
+	if err != nil {
+		return nil, nil, err
+	}
+	res, err := cli.Do(req)
+	if err != nil {
+		return nil, nil, err
+	}
 	defer res.Body.Close()
+	if res.StatusCode != http.StatusOK {
+		return nil, nil, fmt.Errorf("unexpected status code: %v", res.StatusCode)
+	}
 	var out mailbox.Message
-	println("headers", res.Header.Get("Content-Length"))
 	err = out.DecodeMsg(msgp.NewReader(res.Body))
 	if err != nil {
-		return nil, err
+		return nil, nil, err
 	}
-	return &out, nil
+	return &out, res, nil
+}
+
+// Call posts msg and waits until a reply to it arrives at the inbox of msg.From,
+// see mailbox.CallFunc for details.
+func Call(ctx context.Context, cli *http.Client, urlPrefix string, msg *mailbox.Message) (*mailbox.Message, error) {
+	return mailbox.CallFunc(ctx, msg,
+		func(ctx context.Context, msg *mailbox.Message) error {
+			return Post(ctx, cli, urlPrefix, msg)
+		},
+		func(ctx context.Context, inbox uuid.UUID) (*mailbox.Message, error) {
+			return Get(ctx, cli, urlPrefix, inbox)
+		})
 }
@@ -2,15 +2,21 @@ package api_test
 
 import (
 	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
 	"net/http"
 	"net/http/httptest"
 	"reflect"
+	"strings"
 	"testing"
 	"time"
 
 	"github.com/andrebq/mixtape/mailbox"
 	"github.com/andrebq/mixtape/mailbox/api"
 	"github.com/google/uuid"
+	sdktrace "go.opentelemetry.io/otel/sdk/trace"
+	"go.opentelemetry.io/otel/sdk/trace/tracetest"
 )
 
 func TestHandler(t *testing.T) {
@@ -31,13 +37,596 @@ func TestHandler(t *testing.T) {
 			Process: 1,
 		},
 		Payload: []byte("hello world"),
+		SentAt:  time.Now().Round(0),
 	}
 	if err := api.Post(ctx, http.DefaultClient, srv.URL, &msg); err != nil {
 		t.Fatal(err)
 	}
 	if actual, err := api.Get(ctx, http.DefaultClient, srv.URL, msg.To.Node); err != nil {
 		t.Fatal(err)
-	} else if !reflect.DeepEqual(*actual, msg) {
+	} else if actual.ArrivedAt.IsZero() {
+		t.Fatal("Message should have an arrival time")
+	} else if msg.ArrivedAt = actual.ArrivedAt; !reflect.DeepEqual(*actual, msg) {
 		t.Fatalf("Expecting msg: \n%#v\ngot\n%#v", msg, *actual)
 	}
 }
+
+func TestCall(t *testing.T) {
+	rack := mailbox.NewRack()
+	defer rack.Close()
+	srv := httptest.NewServer(api.New(rack))
+	defer srv.Close()
+	ctx, cancel := context.WithTimeout(context.Background(), time.Second)
+	defer cancel()
+
+	server := mailbox.Address{Node: uuid.Must(uuid.NewRandom()), Process: 1}
+	client := mailbox.Address{Node: uuid.Must(uuid.NewRandom()), Process: 1}
+	go func() {
+		req, err := api.Get(ctx, http.DefaultClient, srv.URL, server.Node)
+		if err != nil {
+			return
+		}
+		reply := &mailbox.Message{ID: uuid.Must(uuid.NewRandom()), To: req.From, From: server, ReplyTo: req.ID, Payload: []byte("pong"), SentAt: time.Now()}
+		api.Post(ctx, http.DefaultClient, srv.URL, reply)
+	}()
+
+	reply, err := api.Call(ctx, http.DefaultClient, srv.URL, &mailbox.Message{From: client, To: server, Payload: []byte("ping")})
+	if err != nil {
+		t.Fatal(err)
+	} else if string(reply.Payload) != "pong" {
+		t.Fatalf("Unexpected reply %#v", reply)
+	}
+}
+
+func TestLease(t *testing.T) {
+	rack := mailbox.NewRack(mailbox.WithLeaseTimeout(time.Second / 50))
+	defer rack.Close()
+	srv := httptest.NewServer(api.New(rack))
+	defer srv.Close()
+	ctx, cancel := context.WithTimeout(context.Background(), time.Second)
+	defer cancel()
+
+	msg := mailbox.Message{
+		ID:     uuid.Must(uuid.NewRandom()),
+		To:     mailbox.Address{Node: uuid.Must(uuid.NewRandom())},
+		SentAt: time.Now(),
+	}
+	if err := api.Post(ctx, http.DefaultClient, srv.URL, &msg); err != nil {
+		t.Fatal(err)
+	}
+	if _, _, err := api.TakeLease(ctx, http.DefaultClient, srv.URL, msg.To); err != nil {
+		t.Fatal(err)
+	}
+	actual, lease, err := api.TakeLease(ctx, http.DefaultClient, srv.URL, msg.To)
+	if err != nil {
+		t.Fatal(err)
+	} else if actual.ID != msg.ID {
+		t.Fatalf("Message should be delivered again after lease timeout, got %#v", actual)
+	}
+	if err := api.Ack(ctx, http.DefaultClient, srv.URL, msg.To.Node, lease); err != nil {
+		t.Fatal(err)
+	}
+	if err := api.Ack(ctx, http.DefaultClient, srv.URL, msg.To.Node, lease); !errors.Is(err, mailbox.ErrLeaseNotFound) {
+		t.Fatalf("Lease should not be acknowledged twice, got %v", err)
+	}
+}
+
+func TestCancel(t *testing.T) {
+	rack := mailbox.NewRack()
+	defer rack.Close()
+	srv := httptest.NewServer(api.New(rack))
+	defer srv.Close()
+	ctx, cancel := context.WithTimeout(context.Background(), time.Second)
+	defer cancel()
+
+	msg := mailbox.Message{
+		ID:     uuid.Must(uuid.NewRandom()),
+		To:     mailbox.Address{Node: uuid.Must(uuid.NewRandom())},
+		SentAt: time.Now(),
+	}
+	mailbox.DeliverAfter(&msg, time.Now().Add(time.Minute))
+	if err := api.Post(ctx, http.DefaultClient, srv.URL, &msg); err != nil {
+		t.Fatal(err)
+	}
+	if err := api.Cancel(ctx, http.DefaultClient, srv.URL, msg.To.Node, msg.ID); err != nil {
+		t.Fatal(err)
+	}
+	if err := api.Cancel(ctx, http.DefaultClient, srv.URL, msg.To.Node, msg.ID); !errors.Is(err, mailbox.ErrNotScheduled) {
+		t.Fatalf("Message should not be cancelled twice, got %v", err)
+	}
+}
+
+func TestFederation(t *testing.T) {
+	var registry mailbox.Registry
+	siteA := mailbox.NewRack(mailbox.WithRegistry(&registry))
+	defer siteA.Close()
+	siteB := mailbox.NewRack(mailbox.WithRegistry(&registry))
+	defer siteB.Close()
+	srvA := httptest.NewServer(api.New(siteA))
+	defer srvA.Close()
+	srvB := httptest.NewServer(api.New(siteB))
+	defer srvB.Close()
+	ctx, cancel := context.WithTimeout(context.Background(), time.Second)
+	defer cancel()
+
+	consumer := uuid.Must(uuid.NewRandom())
+	// shared registry, siteB must not forward the message back to itself
+	registry.Register(consumer, &api.Client{URL: srvB.URL})
+	gone := uuid.Must(uuid.NewRandom())
+	registry.Register(gone, &api.Client{URL: srvB.URL})
+	registry.Unregister(gone)
+	if _, found := registry.Lookup(gone); found {
+		t.Fatal("Unregistered nodes should not be found")
+	}
+
+	msg := mailbox.Message{
+		ID:     uuid.Must(uuid.NewRandom()),
+		To:     mailbox.Address{Node: consumer},
+		SentAt: time.Now(),
+	}
+	if err := api.Post(ctx, http.DefaultClient, srvA.URL, &msg); err != nil {
+		t.Fatal(err)
+	}
+	if actual, err := api.Get(ctx, http.DefaultClient, srvB.URL, consumer); err != nil {
+		t.Fatal(err)
+	} else if actual.ID != msg.ID {
+		t.Fatalf("Unexpected message %#v", actual)
+	}
+}
+
+func TestGetAddress(t *testing.T) {
+	rack := mailbox.NewRack()
+	defer rack.Close()
+	srv := httptest.NewServer(api.New(rack))
+	defer srv.Close()
+	ctx, cancel := context.WithTimeout(context.Background(), time.Second)
+	defer cancel()
+
+	node := uuid.Must(uuid.NewRandom())
+	for _, process := range []uint64{1, 2} {
+		msg := mailbox.Message{
+			ID:     uuid.Must(uuid.NewRandom()),
+			To:     mailbox.Address{Node: node, Process: process},
+			SentAt: time.Now(),
+		}
+		if err := api.Post(ctx, http.DefaultClient, srv.URL, &msg); err != nil {
+			t.Fatal(err)
+		}
+	}
+	for _, process := range []uint64{2, 1} {
+		addr := mailbox.Address{Node: node, Process: process}
+		if actual, err := api.GetAddress(ctx, http.DefaultClient, srv.URL, addr); err != nil {
+			t.Fatal(err)
+		} else if actual.To != addr {
+			t.Fatalf("Expecting message for %v got %v", addr, actual.To)
+		}
+	}
+}
+
+func TestGetN(t *testing.T) {
+	rack := mailbox.NewRack()
+	defer rack.Close()
+	srv := httptest.NewServer(api.New(rack))
+	defer srv.Close()
+	ctx, cancel := context.WithTimeout(context.Background(), time.Second)
+	defer cancel()
+
+	inbox := mailbox.Address{Node: uuid.Must(uuid.NewRandom())}
+	if msgs, err := api.GetN(ctx, http.DefaultClient, srv.URL, inbox, 10, time.Second/100); err != nil {
+		t.Fatal(err)
+	} else if len(msgs) != 0 {
+		t.Fatalf("Expecting an empty batch got %v", len(msgs))
+	}
+	var sent []uuid.UUID
+	for i := 0; i < 3; i++ {
+		msg := mailbox.Message{ID: uuid.Must(uuid.NewRandom()), To: inbox, SentAt: time.Now()}
+		if err := api.Post(ctx, http.DefaultClient, srv.URL, &msg); err != nil {
+			t.Fatal(err)
+		}
+		sent = append(sent, msg.ID)
+	}
+	msgs, err := api.GetN(ctx, http.DefaultClient, srv.URL, inbox, 10, time.Second)
+	if err != nil {
+		t.Fatal(err)
+	}
+	var received []uuid.UUID
+	for _, m := range msgs {
+		received = append(received, m.ID)
+	}
+	if !reflect.DeepEqual(received, sent) {
+		t.Fatalf("Expecting %v got %v", sent, received)
+	}
+}
+
+func TestStream(t *testing.T) {
+	rack := mailbox.NewRack()
+	defer rack.Close()
+	srv := httptest.NewServer(api.New(rack))
+	defer srv.Close()
+	ctx, cancel := context.WithTimeout(context.Background(), time.Second)
+	defer cancel()
+
+	inbox := mailbox.Address{Node: uuid.Must(uuid.NewRandom())}
+	sent := []uuid.UUID{uuid.Must(uuid.NewRandom()), uuid.Must(uuid.NewRandom()), uuid.Must(uuid.NewRandom())}
+	go func() {
+		for _, id := range sent {
+			msg := mailbox.Message{ID: id, To: inbox, SentAt: time.Now()}
+			if err := api.Post(ctx, http.DefaultClient, srv.URL, &msg); err != nil {
+				return
+			}
+		}
+	}()
+	var received []uuid.UUID
+	for msg, err := range api.Stream(ctx, http.DefaultClient, srv.URL, inbox) {
+		if err != nil {
+			t.Fatal(err)
+		}
+		received = append(received, msg.ID)
+		if len(received) == 3 {
+			break
+		}
+	}
+	if !reflect.DeepEqual(received, sent) {
+		t.Fatalf("Expecting %v got %v", sent, received)
+	}
+}
+
+func TestTail(t *testing.T) {
+	rack := mailbox.NewRack()
+	defer rack.Close()
+	srv := httptest.NewServer(api.New(rack))
+	defer srv.Close()
+	ctx, cancel := context.WithTimeout(context.Background(), time.Second)
+	defer cancel()
+
+	post := func() uuid.UUID {
+		msg := mailbox.Message{ID: uuid.Must(uuid.NewRandom()), To: mailbox.Address{Node: uuid.Must(uuid.NewRandom())}, SentAt: time.Now()}
+		if err := api.Post(ctx, http.DefaultClient, srv.URL, &msg); err != nil {
+			t.Fatal(err)
+		}
+		return msg.ID
+	}
+	first, second := post(), post()
+
+	var last mailbox.LogEntry
+	for e, err := range api.Tail(ctx, http.DefaultClient, srv.URL, 0) {
+		if err != nil {
+			t.Fatal(err)
+		}
+		if e.Offset == 1 && e.Message.ID != first {
+			t.Fatalf("Unexpected first entry %#v", e)
+		}
+		last = e
+		if e.Offset == 2 {
+			break
+		}
+	}
+	if last.Message.ID != second {
+		t.Fatalf("Unexpected last entry %#v", last)
+	}
+
+	// resume after disconnecting
+	third := post()
+	for e, err := range api.Tail(ctx, http.DefaultClient, srv.URL, last.Offset+1) {
+		if err != nil {
+			t.Fatal(err)
+		}
+		if e.Offset != 3 || e.Message.ID != third {
+			t.Fatalf("Unexpected entry after resume %#v", e)
+		}
+		break
+	}
+}
+
+func TestJSON(t *testing.T) {
+	rack := mailbox.NewRack()
+	defer rack.Close()
+	srv := httptest.NewServer(api.New(rack))
+	defer srv.Close()
+
+	inbox := uuid.Must(uuid.NewRandom())
+	body := fmt.Sprintf(`{"id":%q,"to":{"node":%q,"process":1},"payload":"aGVsbG8=","headers":{"kind":["greeting"]},"sentAt":"2026-01-02T03:04:05Z"}`,
+		uuid.Must(uuid.NewRandom()), inbox)
+	res, err := http.Post(srv.URL+"/"+inbox.String(), "application/json", strings.NewReader(body))
+	if err != nil {
+		t.Fatal(err)
+	}
+	res.Body.Close()
+	if res.StatusCode != http.StatusOK {
+		t.Fatalf("Unexpected status %v", res.StatusCode)
+	}
+
+	res, err = http.Post(srv.URL+"/"+inbox.String(), "text/plain", strings.NewReader(body))
+	if err != nil {
+		t.Fatal(err)
+	}
+	res.Body.Close()
+	if res.StatusCode != http.StatusUnsupportedMediaType {
+		t.Fatalf("Expecting 415 got %v", res.StatusCode)
+	}
+
+	get := func(accept string) *http.Response {
+		req, _ := http.NewRequest("GET", srv.URL+"/"+inbox.String(), nil)
+		req.Header.Set("Accept", accept)
+		res, err := http.DefaultClient.Do(req)
+		if err != nil {
+			t.Fatal(err)
+		}
+		return res
+	}
+	res = get("text/html")
+	res.Body.Close()
+	if res.StatusCode != http.StatusNotAcceptable {
+		t.Fatalf("Expecting 406 got %v", res.StatusCode)
+	}
+
+	res = get("text/html, application/json;q=0.9")
+	defer res.Body.Close()
+	if ct := res.Header.Get("Content-Type"); ct != "application/json" {
+		t.Fatalf("Unexpected content type %v", ct)
+	}
+	var msg mailbox.Message
+	if err := json.NewDecoder(res.Body).Decode(&msg); err != nil {
+		t.Fatal(err)
+	}
+	if string(msg.Payload) != "hello" || msg.To.Node != inbox || msg.Headers["kind"][0] != "greeting" || msg.ArrivedAt.IsZero() {
+		t.Fatalf("Unexpected message %#v", msg)
+	}
+}
+
+func TestTokens(t *testing.T) {
+	key := []byte("not so secret")
+	rack := mailbox.NewRack()
+	defer rack.Close()
+	srv := httptest.NewServer(api.New(rack, api.WithTokenKey(key)))
+	defer srv.Close()
+	ctx, cancel := context.WithTimeout(context.Background(), time.Second)
+	defer cancel()
+
+	inbox := uuid.Must(uuid.NewRandom())
+	token := func(perm api.Perm, expires time.Time) string {
+		tk, err := api.SignToken(key, api.Capability{Inboxes: []uuid.UUID{inbox}, Perm: perm, Expires: expires})
+		if err != nil {
+			t.Fatal(err)
+		}
+		return tk
+	}
+	writer := token(api.PermWrite, time.Now().Add(time.Minute))
+	reader := token(api.PermRead, time.Now().Add(time.Minute))
+	expired := token(api.PermRead|api.PermWrite, time.Now().Add(-time.Minute))
+
+	msg := mailbox.Message{ID: uuid.Must(uuid.NewRandom()), To: mailbox.Address{Node: inbox}, SentAt: time.Now()}
+	if err := api.Post(ctx, http.DefaultClient, srv.URL, &msg); err == nil {
+		t.Fatal("Post without token should fail")
+	}
+	if err := api.Post(api.WithToken(ctx, expired), http.DefaultClient, srv.URL, &msg); err == nil {
+		t.Fatal("Post with an expired token should fail")
+	}
+	if err := api.Post(api.WithToken(ctx, reader), http.DefaultClient, srv.URL, &msg); err == nil {
+		t.Fatal("Post with a read only token should fail")
+	}
+	if err := api.Post(api.WithToken(ctx, writer), http.DefaultClient, srv.URL, &msg); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := api.Get(api.WithToken(ctx, writer), http.DefaultClient, srv.URL, inbox); err == nil {
+		t.Fatal("Get with a write only token should fail")
+	}
+	if actual, err := api.Get(api.WithToken(ctx, reader), http.DefaultClient, srv.URL, inbox); err != nil {
+		t.Fatal(err)
+	} else if actual.ID != msg.ID {
+		t.Fatalf("Unexpected message %#v", actual)
+	}
+
+	// scheduled messages are cancelled with a token for their inbox
+	scheduled := mailbox.Message{ID: uuid.Must(uuid.NewRandom()), To: mailbox.Address{Node: inbox}, SentAt: time.Now()}
+	mailbox.DeliverAfter(&scheduled, time.Now().Add(time.Minute))
+	if err := api.Post(api.WithToken(ctx, writer), http.DefaultClient, srv.URL, &scheduled); err != nil {
+		t.Fatal(err)
+	}
+	other, err := api.SignToken(key, api.Capability{Inboxes: []uuid.UUID{uuid.Must(uuid.NewRandom())}, Perm: api.PermWrite, Expires: time.Now().Add(time.Minute)})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := api.Cancel(api.WithToken(ctx, other), http.DefaultClient, srv.URL, inbox, scheduled.ID); err == nil || errors.Is(err, mailbox.ErrNotScheduled) {
+		t.Fatalf("Cancel with a token for another inbox should be forbidden, got %v", err)
+	}
+	if err := api.Cancel(api.WithToken(ctx, writer), http.DefaultClient, srv.URL, inbox, scheduled.ID); err != nil {
+		t.Fatal(err)
+	}
+
+	// the nil inbox is not a wildcard
+	nobody := mailbox.Message{ID: uuid.Must(uuid.NewRandom()), SentAt: time.Now()}
+	if err := api.Post(api.WithToken(ctx, writer), http.DefaultClient, srv.URL, &nobody); err == nil {
+		t.Fatal("Post to the nil inbox should fail")
+	}
+	if _, err := api.Get(api.WithToken(ctx, reader), http.DefaultClient, srv.URL, uuid.Nil); err == nil {
+		t.Fatal("Get from the nil inbox should fail")
+	}
+
+	// leases are acknowledged with a token for the inbox they were taken from
+	leased := mailbox.Message{ID: uuid.Must(uuid.NewRandom()), To: mailbox.Address{Node: inbox}, SentAt: time.Now()}
+	if err := api.Post(api.WithToken(ctx, writer), http.DefaultClient, srv.URL, &leased); err != nil {
+		t.Fatal(err)
+	}
+	_, lease, err := api.TakeLease(api.WithToken(ctx, reader), http.DefaultClient, srv.URL, leased.To)
+	if err != nil {
+		t.Fatal(err)
+	}
+	otherInbox := uuid.Must(uuid.NewRandom())
+	otherReader, err := api.SignToken(key, api.Capability{Inboxes: []uuid.UUID{otherInbox}, Perm: api.PermRead, Expires: time.Now().Add(time.Minute)})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := api.Ack(api.WithToken(ctx, otherReader), http.DefaultClient, srv.URL, inbox, lease); err == nil || errors.Is(err, mailbox.ErrLeaseNotFound) {
+		t.Fatalf("Ack with a token for another inbox should be forbidden, got %v", err)
+	}
+	if err := api.Ack(api.WithToken(ctx, otherReader), http.DefaultClient, srv.URL, otherInbox, lease); !errors.Is(err, mailbox.ErrLeaseNotFound) {
+		t.Fatalf("Leases should only be acknowledged for their inbox, got %v", err)
+	}
+	if err := api.Ack(api.WithToken(ctx, reader), http.DefaultClient, srv.URL, inbox, lease); err != nil {
+		t.Fatal(err)
+	}
+
+	tampered := []byte(reader)
+	tampered[len(tampered)-2] ^= 1
+	if _, err := api.VerifyToken(key, string(tampered), time.Now()); !errors.Is(err, api.ErrInvalidToken) {
+		t.Fatalf("Tampered tokens should be rejected, got %v", err)
+	}
+}
+
+func TestTransport(t *testing.T) {
+	rack := mailbox.NewRack()
+	defer rack.Close()
+	srv := httptest.NewServer(api.New(rack))
+	defer srv.Close()
+
+	for name, transport := range map[string]mailbox.Transport{
+		"Rack":   rack,
+		"Client": &api.Client{URL: srv.URL},
+	} {
+		t.Run(name, func(t *testing.T) {
+			ctx, cancel := context.WithTimeout(context.Background(), time.Second)
+			defer cancel()
+			to := mailbox.Address{Node: uuid.Must(uuid.NewRandom()), Process: 1}
+			var sent []uuid.UUID
+			for range 3 {
+				msg := &mailbox.Message{ID: uuid.Must(uuid.NewRandom()), To: to, SentAt: time.Now()}
+				if err := transport.Deliver(ctx, msg); err != nil {
+					t.Fatal(err)
+				}
+				sent = append(sent, msg.ID)
+			}
+			msg, err := transport.TakeAddress(ctx, to)
+			if err != nil {
+				t.Fatal(err)
+			} else if msg.ID != sent[0] {
+				t.Fatalf("Unexpected message %v", msg.ID)
+			}
+			var received []uuid.UUID
+			for msg, err := range transport.Subscribe(ctx, to) {
+				if err != nil {
+					t.Fatal(err)
+				}
+				received = append(received, msg.ID)
+				if len(received) == 2 {
+					break
+				}
+			}
+			if !reflect.DeepEqual(received, sent[1:]) {
+				t.Fatalf("Expecting %v got %v", sent[1:], received)
+			}
+		})
+	}
+}
+
+func TestTracing(t *testing.T) {
+	recorder := tracetest.NewSpanRecorder()
+	tp := sdktrace.NewTracerProvider(sdktrace.WithSpanProcessor(recorder))
+	defer tp.Shutdown(context.Background())
+	rack := mailbox.NewRack(mailbox.WithTracerProvider(tp))
+	defer rack.Close()
+	srv := httptest.NewServer(api.New(rack, api.WithTracerProvider(tp)))
+	defer srv.Close()
+	ctx, cancel := context.WithTimeout(context.Background(), time.Second)
+	defer cancel()
+
+	oplog := rack.MessageLog(1)
+	ctx, parent := tp.Tracer("test").Start(ctx, "request")
+	headers := map[string][]string{"X-Request": {"1"}}
+	msg := mailbox.Message{
+		ID:      uuid.Must(uuid.NewRandom()),
+		To:      mailbox.Address{Node: uuid.Must(uuid.NewRandom())},
+		SentAt:  time.Now(),
+		Headers: headers,
+	}
+	if err := api.Post(ctx, http.DefaultClient, srv.URL, &msg); err != nil {
+		t.Fatal(err)
+	}
+	parent.End()
+	// the trace context is sent in a copy of the headers
+	if len(headers) != 1 || len(msg.Headers) != 1 {
+		t.Fatalf("Post should not modify the message headers: %v", msg.Headers)
+	}
+	// wait until the message is parked
+	<-oplog
+	if _, err := api.Get(context.Background(), http.DefaultClient, srv.URL, msg.To.Node); err != nil {
+		t.Fatal(err)
+	}
+	names := map[string]bool{}
+	for _, span := range recorder.Ended() {
+		if span.SpanContext().TraceID() != parent.SpanContext().TraceID() {
+			t.Errorf("Span %v is not part of the trace", span.Name())
+		}
+		names[span.Name()] = true
+	}
+	for _, name := range []string{"mailbox.api.post", "mailbox.deliver", "mailbox.park", "mailbox.take"} {
+		if !names[name] {
+			t.Errorf("Missing span %v, got %v", name, names)
+		}
+	}
+}
+
+func TestTokenSenders(t *testing.T) {
+	key := []byte("not so secret")
+	rack := mailbox.NewRack(mailbox.WithSenderLimits(mailbox.Quota(1, time.Minute)))
+	defer rack.Close()
+	srv := httptest.NewServer(api.New(rack, api.WithTokenKey(key)))
+	defer srv.Close()
+	ctx, cancel := context.WithTimeout(context.Background(), time.Second)
+	defer cancel()
+
+	// tokens without a subject do not share their limits
+	inbox := uuid.Must(uuid.NewRandom())
+	post := func(token string) error {
+		return api.Post(api.WithToken(ctx, token), http.DefaultClient, srv.URL, &mailbox.Message{
+			ID:     uuid.Must(uuid.NewRandom()),
+			To:     mailbox.Address{Node: inbox},
+			SentAt: time.Now(),
+		})
+	}
+	var tokens []string
+	for range 2 {
+		tk, err := api.SignToken(key, api.Capability{Inboxes: []uuid.UUID{inbox, uuid.Must(uuid.NewRandom())}, Perm: api.PermWrite, Expires: time.Now().Add(time.Minute)})
+		if err != nil {
+			t.Fatal(err)
+		}
+		tokens = append(tokens, tk)
+	}
+	for _, tk := range tokens {
+		if err := post(tk); err != nil {
+			t.Fatal(err)
+		}
+	}
+	var limited *mailbox.RateLimitError
+	if err := post(tokens[0]); !errors.As(err, &limited) {
+		t.Fatalf("Expecting RateLimitError got %v", err)
+	}
+}
+
+func TestRateLimit(t *testing.T) {
+	rack := mailbox.NewRack(mailbox.WithSenderLimits(mailbox.Quota(1, time.Minute)))
+	defer rack.Close()
+	srv := httptest.NewServer(api.New(rack))
+	defer srv.Close()
+	ctx, cancel := context.WithTimeout(context.Background(), time.Second)
+	defer cancel()
+
+	from := mailbox.Address{Node: uuid.Must(uuid.NewRandom())}
+	post := func() error {
+		return api.Post(ctx, http.DefaultClient, srv.URL, &mailbox.Message{
+			ID:     uuid.Must(uuid.NewRandom()),
+			From:   from,
+			To:     mailbox.Address{Node: uuid.Must(uuid.NewRandom())},
+			SentAt: time.Now(),
+		})
+	}
+	if err := post(); err != nil {
+		t.Fatal(err)
+	}
+	var limited *mailbox.RateLimitError
+	if err := post(); !errors.As(err, &limited) {
+		t.Fatalf("Expecting RateLimitError got %v", err)
+	} else if limited.RetryAfter < time.Minute-time.Second || limited.RetryAfter > time.Minute {
+		t.Fatalf("Unexpected Retry-After %v", limited.RetryAfter)
+	}
+}
@@ -0,0 +1,100 @@
+package api
+
+import (
+	"context"
+	"fmt"
+	"iter"
+	"log/slog"
+	"net/http"
+	"strconv"
+	"strings"
+
+	"github.com/andrebq/mixtape/mailbox"
+	"github.com/tinylib/msgp/msgp"
+)
+
+// tailLog streams the rack message log as msgpack (or JSON) encoded mailbox.LogEntry objects,
+// starting at ?from=
+func tailLog(rack *mailbox.Rack, cfg *config) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		if !cfg.authorizeAny(w, r, PermTail) {
+			return
+		}
+		var from uint64
+		if v := r.URL.Query().Get("from"); v != "" {
+			var err error
+			from, err = strconv.ParseUint(v, 10, 64)
+			if err != nil {
+				http.Error(w, err.Error(), http.StatusBadRequest)
+				return
+			}
+		}
+		mt, err := responseType(r.Header.Get("Accept"))
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusNotAcceptable)
+			return
+		}
+		rc := http.NewResponseController(w)
+		w.Header().Add("Content-Type", mt)
+		w.WriteHeader(http.StatusOK)
+		if err := rc.Flush(); err != nil {
+			slog.ErrorContext(r.Context(), "Streaming not supported", "error", err)
+			return
+		}
+		var buf []byte
+		for e := range rack.Tail(r.Context(), from, 100) {
+			var err error
+			buf, err = appendValue(mt, buf[:0], &e)
+			if err != nil {
+				slog.ErrorContext(r.Context(), "Error encoding log entry", "offset", e.Offset, "error", err)
+				return
+			}
+			if _, err := w.Write(buf); err != nil {
+				return
+			}
+			if err := rc.Flush(); err != nil {
+				return
+			}
+		}
+	}
+}
+
+// Tail follows the message log of the rack starting at offset from,
+// see mailbox.Rack.Tail. To resume after an error, call Tail again with
+// the offset of the last entry received plus one.
+func Tail(ctx context.Context, cli *http.Client, urlPrefix string, from uint64) iter.Seq2[mailbox.LogEntry, error] {
+	return func(yield func(mailbox.LogEntry, error) bool) {
+		ctx, cancel := context.WithCancel(ctx)
+		defer cancel()
+		urlPrefix = strings.TrimSuffix(urlPrefix, "/")
+		req, err := newRequest(ctx, "GET", fmt.Sprintf("%v/_log?from=%v", urlPrefix, from), nil)
+		if err != nil {
+			yield(mailbox.LogEntry{}, err)
+			return
+		}
+		res, err := cli.Do(req)
+		if err != nil {
+			yield(mailbox.LogEntry{}, err)
+			return
+		}
+		defer res.Body.Close()
+		if res.StatusCode != http.StatusOK {
+			yield(mailbox.LogEntry{}, fmt.Errorf("unexpected status code: %v", res.StatusCode))
+			return
+		}
+		rd := msgp.NewReader(res.Body)
+		for {
+			var e mailbox.LogEntry
+			if err := e.DecodeMsg(rd); err != nil {
+				if ctx.Err() != nil {
+					err = ctx.Err()
+				}
+				yield(mailbox.LogEntry{}, err)
+				return
+			}
+			if !yield(e, nil) {
+				return
+			}
+		}
+	}
+}
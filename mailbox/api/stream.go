@@ -0,0 +1,151 @@
+package api
+
+import (
+	"context"
+	"fmt"
+	"iter"
+	"log/slog"
+	"net/http"
+	"strconv"
+	"strings"
+
+	"github.com/andrebq/mixtape/generics"
+	"github.com/andrebq/mixtape/mailbox"
+	"github.com/google/uuid"
+	"github.com/tinylib/msgp/msgp"
+)
+
+type (
+	// listenerLimit caps how many requests can wait on the same inbox
+	listenerLimit struct {
+		max   int
+		count generics.SyncMap[uuid.UUID, int]
+	}
+)
+
+func (l *listenerLimit) acquire(inbox uuid.UUID) bool {
+	ok := true
+	l.count.Update(inbox, func(v int, present bool) (int, bool) {
+		if v >= l.max {
+			ok = false
+			return v, present
+		}
+		return v + 1, true
+	})
+	return ok
+}
+
+func (l *listenerLimit) release(inbox uuid.UUID) {
+	l.count.Update(inbox, func(v int, present bool) (int, bool) {
+		v = v - 1
+		return v, v > 0
+	})
+}
+
+// stream writes each message as a msgpack object (or a line of JSON), flushing after each one,
+// until the client disconnects. ?process= selects the process, following
+// the routing rules of mailbox.Rack.TakeAddress
+func stream(rack *mailbox.Rack, cfg *config, listeners *listenerLimit) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		inbox, err := uuid.Parse(r.PathValue("id"))
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			return
+		}
+		if !cfg.authorize(w, r, inbox, PermRead) {
+			return
+		}
+		var process uint64
+		if p := r.URL.Query().Get("process"); p != "" {
+			process, err = strconv.ParseUint(p, 10, 64)
+			if err != nil {
+				http.Error(w, err.Error(), http.StatusBadRequest)
+				return
+			}
+		}
+		if !listeners.acquire(inbox) {
+			http.Error(w, "Too many listeners for the given inbox", http.StatusTooManyRequests)
+			return
+		}
+		defer listeners.release(inbox)
+
+		mt, err := responseType(r.Header.Get("Accept"))
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusNotAcceptable)
+			return
+		}
+		rc := http.NewResponseController(w)
+		w.Header().Add("Content-Type", mt)
+		w.WriteHeader(http.StatusOK)
+		if err := rc.Flush(); err != nil {
+			slog.ErrorContext(r.Context(), "Streaming not supported", "inbox", inbox, "error", err)
+			return
+		}
+		addr := mailbox.Address{Node: inbox, Process: process}
+		var buf []byte
+		for {
+			msg, lease, err := rack.TakeLease(r.Context(), addr)
+			if err != nil {
+				if r.Context().Err() == nil {
+					slog.ErrorContext(r.Context(), "Error fetching message for stream", "inbox", inbox, "error", err)
+				}
+				return
+			}
+			buf, err = appendValue(mt, buf[:0], msg)
+			if err != nil {
+				slog.ErrorContext(r.Context(), "Error encoding message for stream", "inbox", inbox, "error", err, "messageId", msg.ID)
+				return
+			}
+			if _, err := w.Write(buf); err != nil {
+				return
+			}
+			if err := rc.Flush(); err != nil {
+				return
+			}
+			if err := rack.Ack(context.WithoutCancel(r.Context()), inbox, lease); err != nil {
+				slog.ErrorContext(r.Context(), "Error acknowledging message for stream", "inbox", inbox, "error", err, "messageId", msg.ID)
+			}
+		}
+	}
+}
+
+// Stream opens a streaming subscription for addr and yields each message as it arrives.
+//
+// Iteration stops when the consumer breaks out of the loop, when ctx is done or when
+// the connection fails, in which case the last value contains the error.
+func Stream(ctx context.Context, cli *http.Client, urlPrefix string, addr mailbox.Address) iter.Seq2[*mailbox.Message, error] {
+	return func(yield func(*mailbox.Message, error) bool) {
+		ctx, cancel := context.WithCancel(ctx)
+		defer cancel()
+		urlPrefix = strings.TrimSuffix(urlPrefix, "/")
+		req, err := newRequest(ctx, "GET", fmt.Sprintf("%v/%v/stream?process=%v", urlPrefix, addr.Node, addr.Process), nil)
+		if err != nil {
+			yield(nil, err)
+			return
+		}
+		res, err := cli.Do(req)
+		if err != nil {
+			yield(nil, err)
+			return
+		}
+		defer res.Body.Close()
+		if res.StatusCode != http.StatusOK {
+			yield(nil, fmt.Errorf("unexpected status code: %v", res.StatusCode))
+			return
+		}
+		rd := msgp.NewReader(res.Body)
+		for {
+			var msg mailbox.Message
+			if err := msg.DecodeMsg(rd); err != nil {
+				if ctx.Err() != nil {
+					err = ctx.Err()
+				}
+				yield(nil, err)
+				return
+			}
+			if !yield(&msg, nil) {
+				return
+			}
+		}
+	}
+}
@@ -0,0 +1,216 @@
+package api
+
+import (
+	"context"
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"slices"
+	"strings"
+	"time"
+
+	"github.com/andrebq/mixtape/mailbox"
+	"github.com/google/uuid"
+)
+
+type (
+	// Perm is a set of permissions granted by a Capability
+	Perm uint8
+
+	// Capability is the content of a signed token
+	Capability struct {
+		// Subject identifies who holds the token, sender limits apply per subject
+		// (see WithSender) so tokens without one are limited individually
+		Subject string      `json:"sub,omitempty"`
+		Inboxes []uuid.UUID `json:"inboxes"`
+		Perm    Perm        `json:"perm"`
+		Expires time.Time   `json:"exp"`
+	}
+
+	tokenKey struct{}
+)
+
+const (
+	// PermRead allows taking messages from the inboxes of the capability
+	PermRead Perm = 1 << iota
+	// PermWrite allows posting messages to the inboxes of the capability
+	PermWrite
+	// PermTail allows following the message log of the rack, regardless of inboxes
+	PermTail
+)
+
+var (
+	ErrInvalidToken = errors.New("invalid token")
+	ErrTokenExpired = errors.New("token expired")
+	ErrMissingToken = errors.New("missing bearer token")
+	ErrForbidden    = errors.New("forbidden")
+)
+
+// SignToken returns a bearer token for c signed with HMAC-SHA256.
+//
+// The token is the base64url encoded JSON of c, followed by a dot and
+// the base64url encoded signature.
+func SignToken(key []byte, c Capability) (string, error) {
+	payload, err := json.Marshal(c)
+	if err != nil {
+		return "", err
+	}
+	body := base64.RawURLEncoding.EncodeToString(payload)
+	return body + "." + base64.RawURLEncoding.EncodeToString(sign(key, body)), nil
+}
+
+// VerifyToken checks the signature and expiration of token
+func VerifyToken(key []byte, token string, now time.Time) (Capability, error) {
+	body, sig, found := strings.Cut(token, ".")
+	if !found {
+		return Capability{}, ErrInvalidToken
+	}
+	actual, err := base64.RawURLEncoding.DecodeString(sig)
+	if err != nil || !hmac.Equal(actual, sign(key, body)) {
+		return Capability{}, ErrInvalidToken
+	}
+	payload, err := base64.RawURLEncoding.DecodeString(body)
+	if err != nil {
+		return Capability{}, ErrInvalidToken
+	}
+	var c Capability
+	if err := json.Unmarshal(payload, &c); err != nil {
+		return Capability{}, ErrInvalidToken
+	}
+	if !now.Before(c.Expires) {
+		return Capability{}, ErrTokenExpired
+	}
+	return c, nil
+}
+
+// Allows returns true if c grants perm on inbox
+func (c Capability) Allows(inbox uuid.UUID, perm Perm) bool {
+	if !c.AllowsAny(perm) {
+		return false
+	}
+	if perm&(PermRead|PermWrite) == 0 {
+		return true
+	}
+	return slices.Contains(c.Inboxes, inbox)
+}
+
+// AllowsAny returns true if c grants perm, regardless of inboxes. It is meant
+// for operations which are not bound to an inbox, like acknowledging a lease.
+func (c Capability) AllowsAny(perm Perm) bool {
+	return c.Perm&perm == perm
+}
+
+// WithToken returns a context which makes the client helpers (Post, Get, ...)
+// send token as a bearer token
+func WithToken(ctx context.Context, token string) context.Context {
+	return context.WithValue(ctx, tokenKey{}, token)
+}
+
+func sign(key []byte, body string) []byte {
+	mac := hmac.New(sha256.New, key)
+	mac.Write([]byte(body))
+	return mac.Sum(nil)
+}
+
+// newRequest creates a request which carries the token from ctx, if any
+func newRequest(ctx context.Context, method, url string, body io.Reader) (*http.Request, error) {
+	req, err := http.NewRequestWithContext(ctx, method, url, body)
+	if err != nil {
+		return nil, err
+	}
+	if token, ok := ctx.Value(tokenKey{}).(string); ok && token != "" {
+		req.Header.Set("Authorization", "Bearer "+token)
+	}
+	return req, nil
+}
+
+// Authenticate verifies the bearer token in authorization (the value of an
+// Authorization header), the capability is nil when key is empty, meaning
+// tokens are not required. The HTTP handler and the gRPC server (see mailbox/rpc)
+// share it, along with Authorize and WithSender.
+func Authenticate(key []byte, authorization string, now time.Time) (*Capability, error) {
+	if len(key) == 0 {
+		return nil, nil
+	}
+	token, found := strings.CutPrefix(authorization, "Bearer ")
+	if !found || token == "" {
+		return nil, ErrMissingToken
+	}
+	capability, err := VerifyToken(key, token, now)
+	if err != nil {
+		return nil, err
+	}
+	return &capability, nil
+}
+
+// Authorize returns ErrForbidden unless c grants perm on inbox,
+// a nil capability (see Authenticate) allows everything
+func Authorize(c *Capability, inbox uuid.UUID, perm Perm) error {
+	if c != nil && !c.Allows(inbox, perm) {
+		return fmt.Errorf("%w: token does not grant access to inbox", ErrForbidden)
+	}
+	return nil
+}
+
+// AuthorizeAny is like Authorize for requests which are not bound to an inbox
+func AuthorizeAny(c *Capability, perm Perm) error {
+	if c != nil && !c.AllowsAny(perm) {
+		return fmt.Errorf("%w: token does not grant the required permission", ErrForbidden)
+	}
+	return nil
+}
+
+// WithSender makes the rack apply its sender limits (see mailbox.WithSenderLimits)
+// to the holder of c instead of the From.Node of the messages, which anyone can set.
+// Tokens without a subject are identified by their content instead
+func WithSender(ctx context.Context, c *Capability) context.Context {
+	if c == nil {
+		return ctx
+	} else if c.Subject != "" {
+		return mailbox.WithSender(ctx, "token:"+c.Subject)
+	}
+	// tokens with the same content have the same signature, so they are the same token
+	payload, _ := json.Marshal(c)
+	sum := sha256.Sum256(payload)
+	return mailbox.WithSender(ctx, "token#"+base64.RawURLEncoding.EncodeToString(sum[:16]))
+}
+
+// authorize checks if the request carries a token which grants perm on inbox,
+// writing the error response when it does not. If no key is configured,
+// every request is allowed.
+func (c *config) authorize(w http.ResponseWriter, r *http.Request, inbox uuid.UUID, perm Perm) bool {
+	_, ok := c.capability(w, r, inbox, perm)
+	return ok
+}
+
+// authorizeAny is like authorize for requests which are not bound to an inbox
+func (c *config) authorizeAny(w http.ResponseWriter, r *http.Request, perm Perm) bool {
+	capability, err := Authenticate(c.tokenKey, r.Header.Get("Authorization"), time.Now())
+	if err == nil {
+		err = AuthorizeAny(capability, perm)
+	}
+	if err != nil {
+		writeError(w, err)
+		return false
+	}
+	return true
+}
+
+// capability is like authorize but also returns the verified capability,
+// which is nil when no token key is configured
+func (c *config) capability(w http.ResponseWriter, r *http.Request, inbox uuid.UUID, perm Perm) (*Capability, bool) {
+	capability, err := Authenticate(c.tokenKey, r.Header.Get("Authorization"), time.Now())
+	if err == nil {
+		err = Authorize(capability, inbox, perm)
+	}
+	if err != nil {
+		writeError(w, err)
+		return nil, false
+	}
+	return capability, true
+}
@@ -0,0 +1,47 @@
+package api
+
+import (
+	"context"
+
+	"github.com/andrebq/mixtape/mailbox"
+	"go.opentelemetry.io/otel"
+	"go.opentelemetry.io/otel/attribute"
+	"go.opentelemetry.io/otel/codes"
+	"go.opentelemetry.io/otel/trace"
+)
+
+const tracerName = "github.com/andrebq/mixtape/mailbox/api"
+
+// WithTracerProvider reports handler spans to tp, by default the global
+// provider (otel.GetTracerProvider) is used
+func WithTracerProvider(tp trace.TracerProvider) Option {
+	return func(c *config) {
+		c.tracerProvider = tp
+	}
+}
+
+func (c *config) tracer() trace.Tracer {
+	if c.tracerProvider == nil {
+		return otel.Tracer(tracerName)
+	}
+	return c.tracerProvider.Tracer(tracerName)
+}
+
+// startPost starts the server span for a posted message, continuing the trace
+// stored in its headers unless ctx already has a span
+func (c *config) startPost(ctx context.Context, msg *mailbox.Message) (context.Context, trace.Span) {
+	if !trace.SpanContextFromContext(ctx).IsValid() {
+		ctx = mailbox.ExtractTraceContext(ctx, msg)
+	}
+	return c.tracer().Start(ctx, "mailbox.api.post", trace.WithSpanKind(trace.SpanKindServer),
+		trace.WithAttributes(attribute.String("messaging.message.id", msg.ID.String())))
+}
+
+// endSpan ends span recording err, if any
+func endSpan(span trace.Span, err error) {
+	if err != nil {
+		span.RecordError(err)
+		span.SetStatus(codes.Error, err.Error())
+	}
+	span.End()
+}
@@ -3,115 +3,395 @@ package mailbox
 import (
 	"context"
 	"errors"
+	"log/slog"
 	"runtime"
+	"slices"
 	"sync"
+	"sync/atomic"
 	"time"
 
 	"github.com/andrebq/mixtape/generics"
 	"github.com/google/uuid"
+	"go.opentelemetry.io/otel/metric"
+	"go.opentelemetry.io/otel/trace"
 )
 
 type (
 	Rack struct {
 		l            sync.RWMutex
-		msglog       chan *Message
-		newFollower  chan chan<- *Message
+		msglog       chan entry
+		newFollower  chan follower
+		newTail      chan tail
+		dropTail     chan chan LogEntry
 		newConsumer  chan consumer
 		dropConsumer chan consumer
+		acks         chan ack
+		cancels      chan cancellation
 		closed       chan signal
+		done         chan signal
+
+		journal      journal
+		leaseTimeout time.Duration
+		registry     *Registry
+		logHistory   int
+		maxParked    int
+		ttl          time.Duration
+		inboxDepth   int
+		overflow     OverflowPolicy
+		horizon      time.Duration
+		deadLetterTo *Address
+		maxDead      int
+		dedup        *dedupWindow
+		limits       *senderLimits
+		topics       generics.SyncMap[uuid.UUID, []Address]
+
+		meterProvider  metric.MeterProvider
+		metrics        *rackMetrics
+		tracerProvider trace.TracerProvider
+		tracer         trace.Tracer
 	}
 
+	// Option configures optional behaviour of a Rack
+	Option func(*Rack)
+
 	signal struct{}
 
+	entry struct {
+		msg    *Message
+		seq    int64
+		offset uint64
+		expire time.Time
+		// due is set for messages which must stay invisible until then
+		due time.Time
+		// dead is set for dead letters, see WithDeadLetter
+		dead bool
+		// result is only set when Deliver waits for the rack decision
+		result chan error
+	}
+
+	follower struct {
+		output  chan<- *Message
+		filters []Filter
+	}
+
 	consumer struct {
+		addr  Address
+		lease bool
+		// immediate consumers are not registered when there are no
+		// parked messages, instead they receive an empty handoff
+		immediate bool
+		output    chan handoff
+		// claim is set by the rack before sending a message to output and
+		// by the consumer when it gives up, whichever comes first wins
+		claim *atomic.Int32
+	}
+
+	handoff struct {
+		msg   *Message
+		lease uuid.UUID
+	}
+
+	leased struct {
+		entry
+		deadline time.Time
+	}
+
+	ack struct {
 		inbox  uuid.UUID
-		output chan *Message
+		lease  uuid.UUID
+		result chan error
 	}
+
+	// rackLoop holds the state owned by the runLog goroutine
+	rackLoop struct {
+		*Rack
+		followers map[chan<- *Message][]Filter
+		tails     map[chan LogEntry][]Filter
+		history   []LogEntry
+		offset    uint64
+		// reserved is the last offset stored in the journal, see reserveOffsets
+		reserved  uint64
+		consumers *waitlist
+		parked    *parking
+		leases    map[uuid.UUID]leased
+		scheduled []entry
+		wakeup    *time.Timer
+	}
+)
+
+const (
+	claimWaiting int32 = iota
+	claimGiven
+	claimCancelled
 )
 
 var (
 	ErrInboxNotFound = errors.New("inbox not found")
 	ErrRackClosed    = errors.New("rack closed")
+	ErrMissingSentAt = errors.New("message without sender timestamp")
+	ErrLeaseNotFound = errors.New("lease not found or already expired")
 )
 
-func NewRack() *Rack {
+// WithLeaseTimeout sets how long a message taken with TakeLease stays
+// invisible to other consumers before it is delivered again, defaults to 30 seconds
+func WithLeaseTimeout(d time.Duration) Option {
+	return func(r *Rack) {
+		r.leaseTimeout = d
+	}
+}
+
+func NewRack(opts ...Option) *Rack {
+	r := newRack(nopJournal{}, opts)
+	go r.runLog(nil, 0)
+	return r
+}
+
+// NewDurableRack returns a Rack which keeps every delivered message
+// in a SQLite database at path until a consumer receives it
+// (or acknowledges it, when taken with TakeLease).
+//
+// Messages which were not taken before the rack was closed (or the process
+// crashed) are loaded back from path and become available to Take again.
+func NewDurableRack(path string, opts ...Option) (*Rack, error) {
+	j, err := openJournal(context.Background(), path)
+	if err != nil {
+		return nil, err
+	}
+	pending, err := j.pending(context.Background(), time.Now())
+	if err != nil {
+		j.Close()
+		return nil, err
+	}
+	offset, err := j.reserved(context.Background())
+	if err != nil {
+		j.Close()
+		return nil, err
+	}
+	r := newRack(j, opts)
+	go r.runLog(pending, offset)
+	return r, nil
+}
+
+func newRack(j journal, opts []Option) *Rack {
 	r := &Rack{
 		closed:       make(chan signal),
-		msglog:       make(chan *Message, 1000),
-		newFollower:  make(chan chan<- *Message),
+		done:         make(chan signal),
+		msglog:       make(chan entry, 1000),
+		newFollower:  make(chan follower),
+		newTail:      make(chan tail),
+		dropTail:     make(chan chan LogEntry),
 		newConsumer:  make(chan consumer, runtime.NumCPU()*2),
 		dropConsumer: make(chan consumer, runtime.NumCPU()*2),
+		acks:         make(chan ack),
+		cancels:      make(chan cancellation),
+		journal:      j,
+		leaseTimeout: 30 * time.Second,
+		logHistory:   1000,
+		maxParked:    1000,
+		ttl:          time.Minute,
+		horizon:      24 * time.Hour,
+	}
+	for _, o := range opts {
+		o(r)
 	}
-	go r.runLog()
+	r.metrics = mustRackMetrics(r.meterProvider)
+	r.tracer = newTracer(r.tracerProvider)
 	return r
 }
 
-func (r *Rack) runLog() {
-	followers := map[chan<- *Message]struct{}{}
-	consumers := map[chan<- *Message]uuid.UUID{}
+func (r *Rack) runLog(pending []entry, offset uint64) {
+	l := rackLoop{
+		Rack:      r,
+		offset:    offset,
+		reserved:  offset,
+		followers: map[chan<- *Message][]Filter{},
+		tails:     map[chan LogEntry][]Filter{},
+		consumers: newWaitlist(),
+		parked:    newParking(),
+		leases:    map[uuid.UUID]leased{},
+		wakeup:    time.NewTimer(time.Hour),
+	}
+	l.wakeup.Stop()
+	defer l.wakeup.Stop()
+	defer close(r.done)
 	defer func() {
-		for k := range followers {
+		for k := range l.followers {
 			close(k)
 		}
-		for k := range consumers {
+		for k := range l.tails {
 			close(k)
 		}
+		for c := range l.consumers.all() {
+			close(c.output)
+		}
 	}()
-	oldMessages := map[*Message]time.Time{}
+	now := time.Now()
+	for _, e := range pending {
+		e.due, _ = dueAt(e.msg)
+		e.dead = l.isDeadLetter(e.msg)
+		if e.due.After(now) {
+			l.schedule(e)
+			continue
+		}
+		l.parked.push(e)
+	}
+	ticker := time.NewTicker(max(min(r.leaseTimeout/4, time.Second), 10*time.Millisecond))
+	defer ticker.Stop()
 	for {
+		l.metrics.observe(l.parked.len(), l.consumers.len())
 		select {
 		case <-r.closed:
 			return
+		case now := <-ticker.C:
+			l.expireLeases(now)
 		case c := <-r.newConsumer:
-			now := time.Now()
-			delivered := false
-			for msg, expire := range oldMessages {
-				if expire.Before(now) {
-					delete(oldMessages, msg)
-				}
-				if c.inbox == msg.To.Node {
-					delivered = generics.NonBlockSend(c.output, msg)
-					delete(oldMessages, msg)
-					break
+			if c.claim.Load() == claimCancelled {
+				// the consumer gave up before it was registered
+				continue
+			}
+			l.expire(time.Now())
+			if old, found := l.parked.pop(c.addr); found {
+				if l.give(c, old) {
+					// old message already sent
+					continue
 				}
+				l.parked.pushFront(old)
 			}
-			if delivered {
-				// old message already sent
+			if c.immediate {
+				c.output <- handoff{}
 				continue
 			}
-			consumers[c.output] = c.inbox
+			l.consumers.add(c)
 		case c := <-r.dropConsumer:
-			delete(consumers, c.output)
+			l.consumers.remove(c)
 		case nf := <-r.newFollower:
-			followers[nf] = struct{}{}
-		case m := <-r.msglog:
-			for k := range followers {
-				generics.NonBlockSend(k, m)
-			}
-			var delivered bool
-			for k, v := range consumers {
-				if v == m.To.Node {
-					delivered = generics.NonBlockSend(k, m)
-					delete(consumers, k)
-				}
-			}
-			if !delivered {
-				// add to old messages if space is available
-				now := time.Now()
-				for old, expire := range oldMessages {
-					if expire.Before(now) {
-						// TODO: delete oldest messages instead of just expired ones?
-						delete(oldMessages, old)
-					}
-				}
-				if len(oldMessages) < 1000 {
-					oldMessages[m] = time.Now().Add(time.Minute)
-				}
+			l.followers[nf.output] = nf.filters
+		case t := <-r.newTail:
+			l.addTail(t)
+		case t := <-r.dropTail:
+			delete(l.tails, t)
+		case a := <-r.acks:
+			a.result <- l.ack(a.inbox, a.lease)
+		case c := <-r.cancels:
+			c.result <- l.cancel(c.inbox, c.id)
+		case now := <-l.wakeup.C:
+			l.release(now)
+		case e := <-r.msglog:
+			if e.due.After(time.Now()) {
+				e.respond(l.schedule(e))
+				continue
 			}
+			e.respond(l.enqueue(e))
+		}
+	}
+}
+
+// enqueue makes e visible, handing it to a consumer or parking it.
+// The message log and followers only see e once the rack kept it
+func (l *rackLoop) enqueue(e entry) error {
+	// parked messages are ordered by offset, so it is assigned upfront
+	e.offset = l.offset + 1
+	if !l.dispatch(e) {
+		if kept, err := l.park(e); !kept {
+			return err
+		}
+	}
+	l.publish(e.msg)
+	return nil
+}
+
+// publish records m in the message log and sends it to the followers
+func (l *rackLoop) publish(m *Message) {
+	l.record(m)
+	for k, filters := range l.followers {
+		if matchAny(filters, m) && !generics.NonBlockSend(k, m) {
+			l.metrics.add(l.metrics.followerDropped)
+		}
+	}
+}
+
+// respond sends the result to Deliver, if it is waiting for one
+func (e entry) respond(err error) {
+	if e.result != nil {
+		e.result <- err
+	}
+}
+
+// dispatch hands e to the consumer which waited the longest for its inbox,
+// returns false if no consumer could receive it
+func (l *rackLoop) dispatch(e entry) bool {
+	for {
+		c, found := l.consumers.next(e.msg.To)
+		if !found {
+			return false
+		}
+		// c might have given up while still in the waitlist, its
+		// drop request is on the way and c can be discarded
+		if l.give(c, e) {
+			return true
+		}
+	}
+}
+
+// give hands e to the consumer, the message is kept until it is acknowledged,
+// which happens as soon as consumers without a lease receive it.
+// Returns false if the consumer gave up
+func (l *rackLoop) give(c consumer, e entry) bool {
+	if !c.claim.CompareAndSwap(claimWaiting, claimGiven) {
+		return false
+	}
+	h := handoff{msg: e.msg, lease: uuid.Must(uuid.NewRandom())}
+	// c was already removed from the waitlist, update the gauges
+	// before the consumer can see the message
+	l.metrics.observe(l.parked.len(), l.consumers.len())
+	// the claim guarantees output is empty and c receives h
+	c.output <- h
+	l.leases[h.lease] = leased{entry: e, deadline: time.Now().Add(l.leaseTimeout)}
+	l.metrics.add(l.metrics.delivered)
+	return true
+}
+
+// expire removes parked messages which expired before now
+func (l *rackLoop) expire(now time.Time) {
+	l.parked.expire(now, func(e entry) {
+		l.metrics.add(l.metrics.expired)
+		l.forget(e)
+		l.deadLetter(e, ReasonExpired)
+	})
+}
+
+func (l *rackLoop) ack(inbox, lease uuid.UUID) error {
+	le, found := l.leases[lease]
+	if !found || le.msg.To.Node != inbox {
+		return ErrLeaseNotFound
+	}
+	delete(l.leases, lease)
+	l.forget(le.entry)
+	return nil
+}
+
+// expireLeases makes messages whose lease expired visible again,
+// they are handed to a waiting consumer or placed back at the head of their inbox
+func (l *rackLoop) expireLeases(now time.Time) {
+	for id, le := range l.leases {
+		if le.deadline.After(now) {
+			continue
+		}
+		delete(l.leases, id)
+		if !l.dispatch(le.entry) {
+			l.parked.pushFront(le.entry)
 		}
 	}
 }
 
+// forget removes the entry from the journal, after that point
+// the message will not survive a restart of the rack
+func (r *Rack) forget(e entry) {
+	if err := r.journal.remove(e.seq); err != nil {
+		slog.Error("Unable to remove message from journal", "messageId", e.msg.ID, "seq", e.seq, "error", err)
+	}
+}
+
 func (r *Rack) Close() error {
 	r.l.Lock()
 	select {
@@ -121,47 +401,277 @@ func (r *Rack) Close() error {
 	default:
 		close(r.closed)
 		r.l.Unlock()
-		return nil
+		<-r.done
+		r.metrics.close()
+		return r.journal.Close()
 	}
 }
 
+// Deliver accepts msg into the rack and stamps its ArrivedAt field,
+// messages without SentAt are rejected with ErrMissingSentAt.
+//
+// Messages are parked until a consumer takes them, for as long as the rack
+// retention allows (see WithRetention and TTLHeader). When the rack is full,
+// the overflow policy decides what happens to the message (see WithOverflow).
+//
+// If the rack has a Registry and the recipient is registered there,
+// msg is forwarded to its home rack instead. Messages sent to a topic
+// are copied to each subscriber (see Join).
+//
+// Senders which exceed their limits (see WithSenderLimits) get a *RateLimitError.
+//
+// The trace context of ctx (or the one already in the headers of msg) is
+// propagated in a copy of the headers of msg, which replaces them once msg
+// is accepted, see InjectTraceContext.
 func (r *Rack) Deliver(ctx context.Context, msg *Message) error {
+	ctx, span := r.startDeliver(ctx, msg)
+	err := r.deliver(ctx, msg)
+	endSpan(span, err)
+	return err
+}
+
+func (r *Rack) deliver(ctx context.Context, msg *Message) error {
+	if msg.SentAt.IsZero() {
+		return ErrMissingSentAt
+	}
+	if r.limits != nil {
+		if err := r.limits.allow(sender(ctx, msg), time.Now()); err != nil {
+			r.metrics.add(r.metrics.rateLimited)
+			return err
+		}
+	}
 	select {
-	case r.msglog <- msg:
-		return nil
+	case <-r.closed:
+		return ErrRackClosed
+	default:
+	}
+	if _, err := r.expiration(msg); err != nil {
+		return err
+	}
+	if forwarded, err := r.forward(ctx, msg); forwarded {
+		return err
+	}
+	if r.dedup != nil {
+		if !r.dedup.claim(msg.ID, time.Now()) {
+			r.metrics.add(r.metrics.duplicates)
+			return nil
+		}
+	}
+	InjectTraceContext(ctx, msg)
+	err := r.deliverLocal(ctx, msg)
+	if err != nil && r.dedup != nil {
+		r.dedup.release(msg.ID)
+	}
+	return err
+}
+
+// deliverLocal delivers msg to the inboxes (or topic) managed by this rack
+func (r *Rack) deliverLocal(ctx context.Context, msg *Message) error {
+	// wall clock only, monotonic readings are meaningless to other processes
+	msg.ArrivedAt = time.Now().Round(0)
+	if topic, err := r.fanOut(ctx, msg); topic {
+		return err
+	}
+	return r.accept(ctx, msg)
+}
+
+// accept stores msg in the journal and hands it to the rack loop
+func (r *Rack) accept(ctx context.Context, msg *Message) error {
+	expire, err := r.expiration(msg)
+	if err != nil {
+		return err
+	}
+	seq, err := r.journal.append(ctx, msg, expire)
+	if err != nil {
+		return err
+	}
+	due, _ := dueAt(msg)
+	e := entry{msg: msg, seq: seq, expire: expire, due: due}
+	if r.overflow == RejectNew || due.After(time.Now()) {
+		e.result = make(chan error, 1)
+	}
+	select {
+	case r.msglog <- e:
+	case <-r.closed:
+		return ErrRackClosed
 	case <-ctx.Done():
 		return ctx.Err()
 	}
+	if e.result == nil {
+		return nil
+	}
+	select {
+	case err := <-e.result:
+		return err
+	case <-r.closed:
+		return ErrRackClosed
+	}
 }
 
-func (r *Rack) MessageLog(buf int) <-chan *Message {
+// MessageLog returns a channel which receives every message delivered
+// to the rack from now on. If filters are given, only messages accepted
+// by at least one of them are sent to the channel.
+//
+// Filters are evaluated inside the rack, messages which do not fit in the
+// channel buffer are dropped.
+func (r *Rack) MessageLog(buf int, filters ...Filter) <-chan *Message {
 	if buf < 0 {
 		buf = 1
 	}
 	ch := make(chan *Message, buf)
-	r.newFollower <- ch
+	r.newFollower <- follower{output: ch, filters: slices.Clone(filters)}
 	return ch
 }
 
+// Take waits for the next message addressed to node, regardless of
+// its process
 func (r *Rack) Take(ctx context.Context, node uuid.UUID) (*Message, error) {
-	cons := consumer{
-		inbox:  node,
-		output: make(chan *Message, 1),
+	return r.TakeAddress(ctx, Address{Node: node})
+}
+
+// TakeAddress waits for the next message addressed to addr.
+//
+// A Process equal to 0 works as a wildcard: consumers with Process 0 take messages for
+// any process of the node, and messages sent to Process 0 are taken by any consumer of the node.
+func (r *Rack) TakeAddress(ctx context.Context, addr Address) (*Message, error) {
+	h, err := r.take(ctx, consumer{addr: addr})
+	return h.msg, err
+}
+
+// TakeLease works like TakeAddress but the message is only removed from the rack
+// after Ack is called with the returned lease. If the lease is not acknowledged
+// within the lease timeout (see WithLeaseTimeout), the message becomes visible
+// again and might be delivered to another consumer.
+func (r *Rack) TakeLease(ctx context.Context, addr Address) (*Message, uuid.UUID, error) {
+	h, err := r.take(ctx, consumer{addr: addr, lease: true})
+	return h.msg, h.lease, err
+}
+
+// Ack removes a message taken with TakeLease from inbox, returns ErrLeaseNotFound
+// if the lease already expired or the message was not taken from inbox
+func (r *Rack) Ack(ctx context.Context, inbox, lease uuid.UUID) error {
+	a := ack{inbox: inbox, lease: lease, result: make(chan error, 1)}
+	select {
+	case r.acks <- a:
+		return <-a.result
+	case <-r.closed:
+		return ErrRackClosed
+	case <-ctx.Done():
+		return ctx.Err()
+	}
+}
+
+// TakeN waits up to wait for at least one message addressed to addr and
+// returns it along with any other message that is already available, up to max messages.
+//
+// If no message arrives before wait expires, TakeN returns an empty slice and no error.
+// When wait <= 0, only messages which are already parked are returned.
+func (r *Rack) TakeN(ctx context.Context, addr Address, max int, wait time.Duration) ([]*Message, error) {
+	batch, err := r.takeN(ctx, consumer{addr: addr}, max, wait)
+	out := make([]*Message, len(batch))
+	for i, h := range batch {
+		out[i] = h.msg
 	}
-	defer generics.NonBlockSend(r.dropConsumer, cons)
+	return out, err
+}
+
+// TakeLeaseN is the batch version of TakeLease, leases[i] must be used
+// to acknowledge msgs[i]
+func (r *Rack) TakeLeaseN(ctx context.Context, addr Address, max int, wait time.Duration) (msgs []*Message, leases []uuid.UUID, err error) {
+	batch, err := r.takeN(ctx, consumer{addr: addr, lease: true}, max, wait)
+	for _, h := range batch {
+		msgs = append(msgs, h.msg)
+		leases = append(leases, h.lease)
+	}
+	return msgs, leases, err
+}
+
+func (r *Rack) takeN(ctx context.Context, cons consumer, max int, wait time.Duration) ([]handoff, error) {
+	if max <= 0 {
+		return nil, nil
+	}
+	waitCtx := ctx
+	if wait > 0 {
+		var cancel context.CancelFunc
+		waitCtx, cancel = context.WithTimeout(ctx, wait)
+		defer cancel()
+	} else {
+		// immediate consumers get an answer without waiting for new messages
+		cons.immediate = true
+	}
+	// take returns a message handed to cons even if waitCtx expired meanwhile
+	first, err := r.take(waitCtx, cons)
+	if err != nil && ctx.Err() != nil {
+		return nil, ctx.Err()
+	} else if errors.Is(err, context.DeadlineExceeded) {
+		return nil, nil
+	} else if err != nil {
+		return nil, err
+	} else if first.msg == nil {
+		return nil, nil
+	}
+	batch := []handoff{first}
+	cons.immediate = true
+	for len(batch) < max {
+		h, err := r.take(ctx, cons)
+		if err != nil || h.msg == nil {
+			break
+		}
+		batch = append(batch, h)
+	}
+	return batch, nil
+}
+
+func (r *Rack) take(ctx context.Context, cons consumer) (handoff, error) {
+	start := time.Now()
+	cons.output = make(chan handoff, 1)
+	cons.claim = new(atomic.Int32)
 	select {
 	case r.newConsumer <- cons:
 		select {
 		case <-ctx.Done():
-			return nil, ctx.Err()
+			return r.abandon(ctx, cons, start, ctx.Err())
 		case <-r.closed:
-			return nil, ErrRackClosed
-		case m := <-cons.output:
-			return m, nil
+			return r.abandon(ctx, cons, start, ErrRackClosed)
+		case h, ok := <-cons.output:
+			return r.received(ctx, cons, h, ok, start)
 		}
 	case <-r.closed:
-		return nil, ErrRackClosed
+		return handoff{}, ErrRackClosed
 	case <-ctx.Done():
-		return nil, ctx.Err()
+		return handoff{}, ctx.Err()
+	}
+}
+
+// abandon cancels the claim of cons and returns err, unless the rack
+// already handed cons a message, which is returned instead
+func (r *Rack) abandon(ctx context.Context, cons consumer, start time.Time, err error) (handoff, error) {
+	if cons.claim.CompareAndSwap(claimWaiting, claimCancelled) {
+		// cons might still be in the waitlist
+		select {
+		case r.dropConsumer <- cons:
+		case <-r.closed:
+		}
+		return handoff{}, err
+	}
+	// the rack sends the handoff right after claiming it
+	h, ok := <-cons.output
+	return r.received(ctx, cons, h, ok, start)
+}
+
+// received acknowledges h once a consumer without a lease has it,
+// until then the message survives a restart of durable racks
+func (r *Rack) received(ctx context.Context, cons consumer, h handoff, ok bool, start time.Time) (handoff, error) {
+	if !ok {
+		return handoff{}, ErrRackClosed
+	}
+	if h.msg == nil {
+		return h, nil
+	}
+	if !cons.lease {
+		r.Ack(context.WithoutCancel(ctx), h.msg.To.Node, h.lease)
+		h.lease = uuid.Nil
 	}
+	r.traceTake(ctx, h.msg, start)
+	return h, nil
 }
@@ -2,12 +2,20 @@ package mailbox_test
 
 import (
 	"context"
+	"errors"
+	"path/filepath"
 	"reflect"
+	"sync"
 	"testing"
 	"time"
 
 	"github.com/andrebq/mixtape/mailbox"
 	"github.com/google/uuid"
+	sdkmetric "go.opentelemetry.io/otel/sdk/metric"
+	"go.opentelemetry.io/otel/sdk/metric/metricdata"
+	sdktrace "go.opentelemetry.io/otel/sdk/trace"
+	"go.opentelemetry.io/otel/sdk/trace/tracetest"
+	"go.opentelemetry.io/otel/trace"
 )
 
 func TestMailbox(t *testing.T) {
@@ -28,9 +36,15 @@ func TestMailbox(t *testing.T) {
 			Node:    uuid.Must(uuid.NewRandom()),
 			Process: 0,
 		},
+		SentAt: time.Now().Round(0),
 	}
 
-	rack.Deliver(ctx, msg)
+	if err := rack.Deliver(ctx, msg); err != nil {
+		t.Fatal(err)
+	}
+	if msg.ArrivedAt.IsZero() {
+		t.Fatal("Rack should set the arrival time of messages")
+	}
 
 	if oplm := <-oplog; !reflect.DeepEqual(oplm, msg) {
 		t.Fatalf("Message from oplog does not match message sent")
@@ -47,3 +61,1253 @@ func TestMailbox(t *testing.T) {
 		t.Fatalf("When there are no messages, the context should expire but got %v", err)
 	}
 }
+
+func TestDurableRack(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "rack.db")
+	rack, err := mailbox.NewDurableRack(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	ctx, cancel := context.WithTimeout(context.Background(), time.Second)
+	defer cancel()
+
+	inbox := uuid.Must(uuid.NewRandom())
+	first := &mailbox.Message{
+		ID:      uuid.Must(uuid.NewRandom()),
+		To:      mailbox.Address{Node: inbox, Process: 1},
+		Payload: []byte("first"),
+		SentAt:  time.Now().Round(0),
+	}
+	second := &mailbox.Message{
+		ID:      uuid.Must(uuid.NewRandom()),
+		To:      mailbox.Address{Node: inbox, Process: 1},
+		Payload: []byte("second"),
+		SentAt:  time.Now().Round(0),
+	}
+	if err := rack.Deliver(ctx, first); err != nil {
+		t.Fatal(err)
+	}
+	if v, err := rack.Take(ctx, inbox); err != nil {
+		t.Fatal(err)
+	} else if !reflect.DeepEqual(v, first) {
+		t.Fatalf("Message from Take does not match message sent")
+	}
+	if err := rack.Deliver(ctx, second); err != nil {
+		t.Fatal(err)
+	}
+	var last uint64
+	for e := range rack.Tail(ctx, 0, 2) {
+		last = e.Offset
+		if e.Message.ID == second.ID {
+			break
+		}
+	}
+	rack.Close()
+
+	rack, err = mailbox.NewDurableRack(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer rack.Close()
+	if v, err := rack.Take(ctx, inbox); err != nil {
+		t.Fatal(err)
+	} else if !reflect.DeepEqual(v, second) {
+		t.Fatalf("Expecting %#v after restart got %#v", second, v)
+	}
+
+	// offsets keep growing after a restart
+	third := &mailbox.Message{ID: uuid.Must(uuid.NewRandom()), To: mailbox.Address{Node: inbox, Process: 1}, SentAt: time.Now()}
+	entries := rack.Tail(ctx, 0, 1)
+	if err := rack.Deliver(ctx, third); err != nil {
+		t.Fatal(err)
+	}
+	if e := <-entries; e.Message.ID != third.ID || e.Offset <= last {
+		t.Fatalf("Expecting an offset after %v got %v", last, e.Offset)
+	}
+	if _, err := rack.Take(ctx, inbox); err != nil {
+		t.Fatal(err)
+	}
+
+	shortCtx, cancel := context.WithTimeout(ctx, time.Second/100)
+	defer cancel()
+	if _, err := rack.Take(shortCtx, inbox); err != shortCtx.Err() {
+		t.Fatalf("Taken messages should not survive a restart but got %v", err)
+	}
+}
+
+func TestParkedMessagesAreFIFO(t *testing.T) {
+	rack := mailbox.NewRack()
+	defer rack.Close()
+
+	ctx, cancel := context.WithTimeout(context.Background(), time.Second)
+	defer cancel()
+
+	inbox := uuid.Must(uuid.NewRandom())
+	var sent []*mailbox.Message
+	for i := 0; i < 100; i++ {
+		msg := &mailbox.Message{
+			ID:     uuid.Must(uuid.NewRandom()),
+			To:     mailbox.Address{Node: inbox, Process: 1},
+			SentAt: time.Now(),
+		}
+		if err := rack.Deliver(ctx, msg); err != nil {
+			t.Fatal(err)
+		}
+		sent = append(sent, msg)
+	}
+	for i, expected := range sent {
+		v, err := rack.Take(ctx, inbox)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if v != expected {
+			t.Fatalf("Message %v is out of order, expecting %v got %v", i, expected.ID, v.ID)
+		}
+	}
+}
+
+func TestMessageLogFilter(t *testing.T) {
+	rack := mailbox.NewRack()
+	defer rack.Close()
+
+	audited := uuid.Must(uuid.NewRandom())
+	oplog := rack.MessageLog(10, mailbox.Filter{
+		To:          mailbox.Address{Node: audited},
+		HeaderMatch: map[string]string{"kind": "audit"},
+	})
+	ctx, cancel := context.WithTimeout(context.Background(), time.Second)
+	defer cancel()
+
+	ignored := []*mailbox.Message{
+		{To: mailbox.Address{Node: uuid.Must(uuid.NewRandom())}, Headers: map[string][]string{"kind": {"audit"}}},
+		{To: mailbox.Address{Node: audited}},
+		{To: mailbox.Address{Node: audited}, Headers: map[string][]string{"kind": {"other"}}},
+	}
+	expected := &mailbox.Message{
+		To:      mailbox.Address{Node: audited, Process: 10},
+		Headers: map[string][]string{"kind": {"other", "audit"}},
+	}
+	for _, msg := range append(ignored, expected) {
+		msg.SentAt = time.Now()
+		if err := rack.Deliver(ctx, msg); err != nil {
+			t.Fatal(err)
+		}
+	}
+	select {
+	case m := <-oplog:
+		if m != expected {
+			t.Fatalf("Filter should only accept %#v but got %#v", expected, m)
+		}
+	case <-ctx.Done():
+		t.Fatal(ctx.Err())
+	}
+}
+
+func TestRejectMissingSentAt(t *testing.T) {
+	rack := mailbox.NewRack()
+	defer rack.Close()
+
+	msg := &mailbox.Message{To: mailbox.Address{Node: uuid.Must(uuid.NewRandom())}}
+	if err := rack.Deliver(context.Background(), msg); !errors.Is(err, mailbox.ErrMissingSentAt) {
+		t.Fatalf("Messages without SentAt should be rejected but got %v", err)
+	}
+}
+
+func TestCall(t *testing.T) {
+	rack := mailbox.NewRack()
+	defer rack.Close()
+
+	ctx, cancel := context.WithTimeout(context.Background(), time.Second)
+	defer cancel()
+
+	server := mailbox.Address{Node: uuid.Must(uuid.NewRandom()), Process: 1}
+	client := mailbox.Address{Node: uuid.Must(uuid.NewRandom()), Process: 1}
+	go func() {
+		req, err := rack.Take(ctx, server.Node)
+		if err != nil {
+			return
+		}
+		stray := &mailbox.Message{ID: uuid.Must(uuid.NewRandom()), To: req.From, From: server, ReplyTo: uuid.Must(uuid.NewRandom()), SentAt: time.Now()}
+		reply := &mailbox.Message{ID: uuid.Must(uuid.NewRandom()), To: req.From, From: server, ReplyTo: req.ID, Payload: []byte("pong"), SentAt: time.Now()}
+		rack.Deliver(ctx, stray)
+		rack.Deliver(ctx, reply)
+	}()
+
+	reply, err := mailbox.Call(ctx, rack, &mailbox.Message{From: client, To: server, Payload: []byte("ping")})
+	if err != nil {
+		t.Fatal(err)
+	} else if string(reply.Payload) != "pong" {
+		t.Fatalf("Unexpected reply %#v", reply)
+	}
+
+	shortCtx, cancel := context.WithTimeout(ctx, time.Second/100)
+	defer cancel()
+	if _, err := mailbox.Call(shortCtx, rack, &mailbox.Message{From: client, To: server}); err != shortCtx.Err() {
+		t.Fatalf("Call without reply should timeout but got %v", err)
+	}
+}
+
+func TestLease(t *testing.T) {
+	rack := mailbox.NewRack(mailbox.WithLeaseTimeout(time.Second / 50))
+	defer rack.Close()
+
+	ctx, cancel := context.WithTimeout(context.Background(), time.Second)
+	defer cancel()
+
+	inbox := uuid.Must(uuid.NewRandom())
+	msg := &mailbox.Message{ID: uuid.Must(uuid.NewRandom()), To: mailbox.Address{Node: inbox}, SentAt: time.Now()}
+	if err := rack.Deliver(ctx, msg); err != nil {
+		t.Fatal(err)
+	}
+	if v, _, err := rack.TakeLease(ctx, msg.To); err != nil {
+		t.Fatal(err)
+	} else if v != msg {
+		t.Fatalf("Unexpected message %#v", v)
+	}
+	// lease not acknowledged, message must become visible again
+	v, lease, err := rack.TakeLease(ctx, msg.To)
+	if err != nil {
+		t.Fatal(err)
+	} else if v != msg {
+		t.Fatalf("Message should be delivered again after lease timeout, got %#v", v)
+	}
+	if err := rack.Ack(ctx, uuid.Must(uuid.NewRandom()), lease); !errors.Is(err, mailbox.ErrLeaseNotFound) {
+		t.Fatalf("Lease should only be acknowledged for its inbox, got %v", err)
+	}
+	if err := rack.Ack(ctx, inbox, lease); err != nil {
+		t.Fatal(err)
+	}
+	if err := rack.Ack(ctx, inbox, lease); !errors.Is(err, mailbox.ErrLeaseNotFound) {
+		t.Fatalf("Lease should not be acknowledged twice, got %v", err)
+	}
+	shortCtx, cancel := context.WithTimeout(ctx, time.Second/10)
+	defer cancel()
+	if _, err := rack.Take(shortCtx, inbox); err != shortCtx.Err() {
+		t.Fatalf("Acknowledged messages should not be delivered again but got %v", err)
+	}
+}
+
+func TestTakeAddress(t *testing.T) {
+	rack := mailbox.NewRack()
+	defer rack.Close()
+
+	ctx, cancel := context.WithTimeout(context.Background(), time.Second)
+	defer cancel()
+
+	node := uuid.Must(uuid.NewRandom())
+	p1 := mailbox.Address{Node: node, Process: 1}
+	p2 := mailbox.Address{Node: node, Process: 2}
+	toP1 := &mailbox.Message{ID: uuid.Must(uuid.NewRandom()), To: p1, SentAt: time.Now()}
+	toP2 := &mailbox.Message{ID: uuid.Must(uuid.NewRandom()), To: p2, SentAt: time.Now()}
+	toAny := &mailbox.Message{ID: uuid.Must(uuid.NewRandom()), To: mailbox.Address{Node: node}, SentAt: time.Now()}
+	for _, m := range []*mailbox.Message{toP1, toP2, toAny} {
+		if err := rack.Deliver(ctx, m); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	if v, err := rack.TakeAddress(ctx, p2); err != nil {
+		t.Fatal(err)
+	} else if v != toP2 {
+		t.Fatalf("Process 2 should receive its own message, got %v", v.ID)
+	}
+	if v, err := rack.TakeAddress(ctx, p2); err != nil {
+		t.Fatal(err)
+	} else if v != toAny {
+		t.Fatalf("Messages to process 0 should be taken by any process, got %v", v.ID)
+	}
+	shortCtx, cancel := context.WithTimeout(ctx, time.Second/100)
+	defer cancel()
+	if _, err := rack.TakeAddress(shortCtx, p2); err != shortCtx.Err() {
+		t.Fatalf("Process 2 should not take messages for process 1, got %v", err)
+	}
+	if v, err := rack.Take(ctx, node); err != nil {
+		t.Fatal(err)
+	} else if v != toP1 {
+		t.Fatalf("Take should work for any process, got %v", v.ID)
+	}
+}
+
+func TestTopicFanOut(t *testing.T) {
+	provider, reader := newMeterProvider(t)
+	rack := mailbox.NewRack(mailbox.WithMeterProvider(provider))
+	defer rack.Close()
+
+	ctx, cancel := context.WithTimeout(context.Background(), time.Second)
+	defer cancel()
+
+	topic := uuid.Must(uuid.NewRandom())
+	online := mailbox.Address{Node: uuid.Must(uuid.NewRandom())}
+	offline := mailbox.Address{Node: uuid.Must(uuid.NewRandom())}
+	rack.Join(topic, online)
+	rack.Join(topic, offline)
+	rack.Join(topic, offline)
+
+	received := make(chan *mailbox.Message, 1)
+	go func() {
+		m, _ := rack.TakeAddress(ctx, online)
+		received <- m
+	}()
+	// the copy for online must be handed to the waiting consumer
+	eventually(ctx, t, func() bool {
+		return metricValues(t, reader)["mailbox.rack.waiting_consumers"] == 1
+	})
+
+	msg := &mailbox.Message{ID: uuid.Must(uuid.NewRandom()), To: mailbox.Address{Node: topic}, SentAt: time.Now()}
+	if err := rack.Deliver(ctx, msg); err != nil {
+		t.Fatal(err)
+	}
+	check := func(m *mailbox.Message, to mailbox.Address) {
+		t.Helper()
+		if m == nil || m.ID != msg.ID || m.To != to {
+			t.Fatalf("Expecting a copy of %v for %v got %#v", msg.ID, to, m)
+		}
+		if v := m.Headers[mailbox.TopicHeader]; len(v) != 1 || v[0] != topic.String() {
+			t.Fatalf("Copy should carry the topic header, got %v", v)
+		}
+	}
+	check(<-received, online)
+	m, err := rack.TakeAddress(ctx, offline)
+	if err != nil {
+		t.Fatal(err)
+	}
+	check(m, offline)
+	shortCtx, cancel := context.WithTimeout(ctx, time.Second/100)
+	defer cancel()
+	if _, err := rack.TakeAddress(shortCtx, offline); err != shortCtx.Err() {
+		t.Fatalf("Subscribers should receive a single copy, got %v", err)
+	}
+
+	rack.Leave(topic, online)
+	rack.Leave(topic, offline)
+	if err := rack.Deliver(ctx, msg); err != nil {
+		t.Fatal(err)
+	}
+	if v, err := rack.Take(ctx, topic); err != nil {
+		t.Fatal(err)
+	} else if v != msg {
+		t.Fatalf("Topics without subscribers should work as a regular inbox, got %#v", v)
+	}
+}
+
+func TestTakeN(t *testing.T) {
+	rack := mailbox.NewRack()
+	defer rack.Close()
+
+	ctx, cancel := context.WithTimeout(context.Background(), time.Second)
+	defer cancel()
+
+	inbox := mailbox.Address{Node: uuid.Must(uuid.NewRandom())}
+	if msgs, err := rack.TakeN(ctx, inbox, 10, time.Second/100); err != nil {
+		t.Fatal(err)
+	} else if len(msgs) != 0 {
+		t.Fatalf("Expecting no messages got %v", len(msgs))
+	}
+
+	var sent []*mailbox.Message
+	for i := 0; i < 5; i++ {
+		msg := &mailbox.Message{ID: uuid.Must(uuid.NewRandom()), To: inbox, SentAt: time.Now()}
+		if err := rack.Deliver(ctx, msg); err != nil {
+			t.Fatal(err)
+		}
+		sent = append(sent, msg)
+	}
+	if msgs, err := rack.TakeN(ctx, inbox, 3, time.Second); err != nil {
+		t.Fatal(err)
+	} else if !reflect.DeepEqual(msgs, sent[:3]) {
+		t.Fatalf("Expecting the first 3 messages got %v", len(msgs))
+	}
+	if msgs, err := rack.TakeN(ctx, inbox, 10, time.Second); err != nil {
+		t.Fatal(err)
+	} else if !reflect.DeepEqual(msgs, sent[3:]) {
+		t.Fatalf("Expecting the remaining messages got %v", len(msgs))
+	}
+}
+
+func TestTakeNWithoutWait(t *testing.T) {
+	rack := mailbox.NewRack()
+	defer rack.Close()
+
+	ctx, cancel := context.WithTimeout(context.Background(), time.Second*5)
+	defer cancel()
+
+	const total = 200
+	inbox := mailbox.Address{Node: uuid.Must(uuid.NewRandom())}
+	oplog := rack.MessageLog(total)
+	var sent []*mailbox.Message
+	for i := 0; i < total; i++ {
+		msg := &mailbox.Message{ID: uuid.Must(uuid.NewRandom()), To: inbox, SentAt: time.Now()}
+		if err := rack.Deliver(ctx, msg); err != nil {
+			t.Fatal(err)
+		}
+		sent = append(sent, msg)
+	}
+	for range total {
+		<-oplog
+	}
+
+	var taken []*mailbox.Message
+	for i := 0; i < total*2; i++ {
+		msgs, err := rack.TakeN(ctx, inbox, 1, 0)
+		if err != nil {
+			t.Fatal(err)
+		}
+		taken = append(taken, msgs...)
+	}
+	if !reflect.DeepEqual(taken, sent) {
+		t.Fatalf("Expecting %v messages in order got %v", total, len(taken))
+	}
+}
+
+func TestTakeNExpiringWait(t *testing.T) {
+	rack := mailbox.NewRack()
+	defer rack.Close()
+
+	ctx, cancel := context.WithTimeout(context.Background(), time.Second*5)
+	defer cancel()
+
+	const total = 500
+	inbox := mailbox.Address{Node: uuid.Must(uuid.NewRandom())}
+	oplog := rack.MessageLog(total)
+	done := make(chan error, 1)
+	go func() {
+		for i := 0; i < total; i++ {
+			msg := &mailbox.Message{ID: uuid.Must(uuid.NewRandom()), To: inbox, SentAt: time.Now()}
+			if err := rack.Deliver(ctx, msg); err != nil {
+				done <- err
+				return
+			}
+		}
+		done <- nil
+	}()
+
+	// waits expire while messages arrive, none of them can be lost
+	taken := map[uuid.UUID]bool{}
+	collect := func(max int, wait time.Duration) {
+		msgs, err := rack.TakeN(ctx, inbox, max, wait)
+		if err != nil {
+			t.Fatal(err)
+		}
+		for _, m := range msgs {
+			if taken[m.ID] {
+				t.Fatalf("Message %v taken twice", m.ID)
+			}
+			taken[m.ID] = true
+		}
+	}
+	for finished := false; !finished; {
+		select {
+		case err := <-done:
+			if err != nil {
+				t.Fatal(err)
+			}
+			finished = true
+		default:
+			collect(1, time.Microsecond*50)
+		}
+	}
+	for range total {
+		<-oplog
+	}
+	collect(total, 0)
+	if len(taken) != total {
+		t.Fatalf("Expecting %v messages got %v", total, len(taken))
+	}
+}
+
+func TestTail(t *testing.T) {
+	rack := mailbox.NewRack(mailbox.WithLogHistory(2))
+	defer rack.Close()
+
+	ctx, cancel := context.WithTimeout(context.Background(), time.Second)
+	defer cancel()
+
+	inbox := mailbox.Address{Node: uuid.Must(uuid.NewRandom())}
+	oplog := rack.MessageLog(3)
+	var sent []*mailbox.Message
+	deliver := func() {
+		msg := &mailbox.Message{ID: uuid.Must(uuid.NewRandom()), To: inbox, SentAt: time.Now()}
+		if err := rack.Deliver(ctx, msg); err != nil {
+			t.Fatal(err)
+		}
+		sent = append(sent, msg)
+	}
+	for i := 0; i < 3; i++ {
+		deliver()
+	}
+	// wait until the rack processed all messages
+	for range 3 {
+		<-oplog
+	}
+	if msgs, err := rack.TakeN(ctx, inbox, 3, time.Second); err != nil || len(msgs) != 3 {
+		t.Fatalf("Unexpected result from TakeN: %v %v", len(msgs), err)
+	}
+
+	// offset 1 is not in the history anymore
+	entries := rack.Tail(ctx, 1, 10)
+	deliver()
+	for i, offset := range []uint64{2, 3, 4} {
+		e := <-entries
+		if e.Offset != offset || e.Message != sent[i+1] {
+			t.Fatalf("Expecting offset %v got %v", offset, e.Offset)
+		}
+	}
+}
+
+func TestMetrics(t *testing.T) {
+	provider, reader := newMeterProvider(t)
+	rack := mailbox.NewRack(mailbox.WithMeterProvider(provider))
+	defer rack.Close()
+
+	ctx, cancel := context.WithTimeout(context.Background(), time.Second)
+	defer cancel()
+
+	inbox := mailbox.Address{Node: uuid.Must(uuid.NewRandom())}
+	oplog := rack.MessageLog(2)
+	// the second message does not fit in the buffer of this follower
+	_ = rack.MessageLog(1)
+	for i := 0; i < 2; i++ {
+		if err := rack.Deliver(ctx, &mailbox.Message{To: inbox, SentAt: time.Now()}); err != nil {
+			t.Fatal(err)
+		}
+	}
+	// wait until both messages are parked
+	<-oplog
+	<-oplog
+	if _, err := rack.TakeAddress(ctx, inbox); err != nil {
+		t.Fatal(err)
+	}
+	// gauges are updated by the rack loop once it is done with the Take above
+	var values map[string]int64
+	eventually(ctx, t, func() bool {
+		values = metricValues(t, reader)
+		return values["mailbox.rack.parked_depth"] == 1
+	})
+	expected := map[string]int64{
+		"mailbox.rack.parked":            2,
+		"mailbox.rack.delivered":         1,
+		"mailbox.rack.follower_dropped":  1,
+		"mailbox.rack.parked_depth":      1,
+		"mailbox.rack.waiting_consumers": 0,
+	}
+	for k, v := range expected {
+		if values[k] != v {
+			t.Errorf("Expecting %v to be %v got %v", k, v, values[k])
+		}
+	}
+}
+
+// newMeterProvider returns a provider whose metrics can be read with metricValues
+func newMeterProvider(t *testing.T) (*sdkmetric.MeterProvider, sdkmetric.Reader) {
+	reader := sdkmetric.NewManualReader()
+	provider := sdkmetric.NewMeterProvider(sdkmetric.WithReader(reader))
+	t.Cleanup(func() { provider.Shutdown(context.Background()) })
+	return provider, reader
+}
+
+// eventually polls cond until it returns true, failing the test if ctx is done first
+func eventually(ctx context.Context, t *testing.T, cond func() bool) {
+	t.Helper()
+	for !cond() {
+		select {
+		case <-ctx.Done():
+			t.Fatalf("Condition not met: %v", ctx.Err())
+		case <-time.After(time.Millisecond):
+		}
+	}
+}
+
+// waitExpired waits until rack removed n expired messages. Parked messages are
+// only checked when the rack is used, so each poll takes from an empty inbox.
+func waitExpired(ctx context.Context, t *testing.T, rack *mailbox.Rack, reader sdkmetric.Reader, n int64) {
+	t.Helper()
+	empty := mailbox.Address{Node: uuid.Must(uuid.NewRandom())}
+	eventually(ctx, t, func() bool {
+		if _, err := rack.TakeN(ctx, empty, 1, 0); err != nil {
+			t.Fatal(err)
+		}
+		return metricValues(t, reader)["mailbox.rack.expired"] >= n
+	})
+}
+
+// metricValues collects the int64 counters and gauges reported to reader
+func metricValues(t *testing.T, reader sdkmetric.Reader) map[string]int64 {
+	t.Helper()
+	var rm metricdata.ResourceMetrics
+	if err := reader.Collect(context.Background(), &rm); err != nil {
+		t.Fatal(err)
+	}
+	values := map[string]int64{}
+	for _, sm := range rm.ScopeMetrics {
+		for _, m := range sm.Metrics {
+			switch data := m.Data.(type) {
+			case metricdata.Sum[int64]:
+				values[m.Name] = data.DataPoints[0].Value
+			case metricdata.Gauge[int64]:
+				values[m.Name] = data.DataPoints[0].Value
+			}
+		}
+	}
+	return values
+}
+
+func TestRetention(t *testing.T) {
+	ctx, cancel := context.WithTimeout(context.Background(), time.Second)
+	defer cancel()
+
+	inbox := mailbox.Address{Node: uuid.Must(uuid.NewRandom())}
+	other := mailbox.Address{Node: uuid.Must(uuid.NewRandom())}
+	newMsg := func(to mailbox.Address) *mailbox.Message {
+		return &mailbox.Message{ID: uuid.Must(uuid.NewRandom()), To: to, SentAt: time.Now()}
+	}
+	ids := func(msgs []*mailbox.Message) []uuid.UUID {
+		var out []uuid.UUID
+		for _, m := range msgs {
+			out = append(out, m.ID)
+		}
+		return out
+	}
+
+	t.Run("EvictOldest", func(t *testing.T) {
+		rack := mailbox.NewRack(mailbox.WithRetention(3, time.Minute), mailbox.WithInboxDepth(2), mailbox.WithOverflow(mailbox.EvictOldest))
+		defer rack.Close()
+		oplog := rack.MessageLog(5)
+		a1, a2, a3, b1, b2 := newMsg(inbox), newMsg(inbox), newMsg(inbox), newMsg(other), newMsg(other)
+		for _, m := range []*mailbox.Message{a1, a2, a3, b1, b2} {
+			if err := rack.Deliver(ctx, m); err != nil {
+				t.Fatal(err)
+			}
+		}
+		// wait until the rack parked every message
+		for range 5 {
+			<-oplog
+		}
+		// a1 is evicted by the inbox depth, a2 by the rack limit
+		if msgs, _ := rack.TakeN(ctx, inbox, 10, time.Second/100); !reflect.DeepEqual(ids(msgs), ids([]*mailbox.Message{a3})) {
+			t.Fatalf("Unexpected messages for inbox %v", ids(msgs))
+		}
+		if msgs, _ := rack.TakeN(ctx, other, 10, time.Second/100); !reflect.DeepEqual(ids(msgs), ids([]*mailbox.Message{b1, b2})) {
+			t.Fatalf("Unexpected messages for other inbox %v", ids(msgs))
+		}
+	})
+
+	t.Run("RejectNew", func(t *testing.T) {
+		rack := mailbox.NewRack(mailbox.WithRetention(1, time.Minute), mailbox.WithOverflow(mailbox.RejectNew))
+		defer rack.Close()
+		if err := rack.Deliver(ctx, newMsg(inbox)); err != nil {
+			t.Fatal(err)
+		}
+		if err := rack.Deliver(ctx, newMsg(inbox)); !errors.Is(err, mailbox.ErrRackFull) {
+			t.Fatalf("Expecting ErrRackFull got %v", err)
+		}
+	})
+
+	t.Run("TTLHeader", func(t *testing.T) {
+		provider, reader := newMeterProvider(t)
+		rack := mailbox.NewRack(mailbox.WithMeterProvider(provider))
+		defer rack.Close()
+		oplog := rack.MessageLog(1)
+		short := newMsg(inbox)
+		short.Headers = map[string][]string{mailbox.TTLHeader: {"1ms"}}
+		if err := rack.Deliver(ctx, short); err != nil {
+			t.Fatal(err)
+		}
+		<-oplog
+		waitExpired(ctx, t, rack, reader, 1)
+		if msgs, _ := rack.TakeN(ctx, inbox, 10, time.Second/100); len(msgs) != 0 {
+			t.Fatalf("Message should have expired")
+		}
+		invalid := newMsg(inbox)
+		invalid.Headers = map[string][]string{mailbox.TTLHeader: {"soon"}}
+		if err := rack.Deliver(ctx, invalid); !errors.Is(err, mailbox.ErrInvalidTTL) {
+			t.Fatalf("Expecting ErrInvalidTTL got %v", err)
+		}
+	})
+
+	t.Run("TTLHeaderAboveRackTTL", func(t *testing.T) {
+		provider, reader := newMeterProvider(t)
+		rack := mailbox.NewRack(mailbox.WithRetention(10, time.Millisecond), mailbox.WithMeterProvider(provider))
+		defer rack.Close()
+		oplog := rack.MessageLog(1)
+		long := newMsg(inbox)
+		long.Headers = map[string][]string{mailbox.TTLHeader: {"1h"}}
+		if err := rack.Deliver(ctx, long); err != nil {
+			t.Fatal(err)
+		}
+		<-oplog
+		waitExpired(ctx, t, rack, reader, 1)
+		if msgs, _ := rack.TakeN(ctx, inbox, 10, time.Second/100); len(msgs) != 0 {
+			t.Fatalf("Message should expire with the rack TTL")
+		}
+	})
+
+	t.Run("MessageLog", func(t *testing.T) {
+		rack := mailbox.NewRack(mailbox.WithRetention(10, time.Minute), mailbox.WithInboxDepth(1))
+		defer rack.Close()
+		kept, dropped, last := newMsg(inbox), newMsg(inbox), newMsg(other)
+		entries := rack.Tail(ctx, 0, 3)
+		for _, m := range []*mailbox.Message{kept, dropped, last} {
+			if err := rack.Deliver(ctx, m); err != nil {
+				t.Fatal(err)
+			}
+		}
+		// messages dropped by the overflow policy are not recorded
+		for i, m := range []*mailbox.Message{kept, last} {
+			if e := <-entries; e.Message != m || e.Offset != uint64(i+1) {
+				t.Fatalf("Expecting %v at offset %v got %v at %v", m.ID, i+1, e.Message.ID, e.Offset)
+			}
+		}
+	})
+}
+
+func TestDeadLetter(t *testing.T) {
+	ctx, cancel := context.WithTimeout(context.Background(), time.Second)
+	defer cancel()
+
+	inbox := mailbox.Address{Node: uuid.Must(uuid.NewRandom()), Process: 1}
+	other := mailbox.Address{Node: uuid.Must(uuid.NewRandom()), Process: 2}
+	dlq := mailbox.Address{Node: uuid.Must(uuid.NewRandom())}
+	provider, reader := newMeterProvider(t)
+	rack := mailbox.NewRack(mailbox.WithRetention(10, time.Minute), mailbox.WithInboxDepth(1), mailbox.WithDeadLetter(dlq), mailbox.WithMeterProvider(provider))
+	defer rack.Close()
+	oplog := rack.MessageLog(2)
+
+	kept := &mailbox.Message{ID: uuid.Must(uuid.NewRandom()), To: inbox, SentAt: time.Now()}
+	// the inbox is full, so the new message is evicted
+	evicted := &mailbox.Message{ID: uuid.Must(uuid.NewRandom()), To: inbox, SentAt: time.Now()}
+	expired := &mailbox.Message{ID: uuid.Must(uuid.NewRandom()), To: other, SentAt: time.Now(),
+		Headers: map[string][]string{mailbox.TTLHeader: {"1ms"}}}
+	for _, m := range []*mailbox.Message{kept, evicted, expired} {
+		if err := rack.Deliver(ctx, m); err != nil {
+			t.Fatal(err)
+		}
+	}
+	// evicted messages are not recorded, messages are processed in order
+	// so evicted was already dropped once expired is recorded
+	<-oplog
+	<-oplog
+	waitExpired(ctx, t, rack, reader, 1)
+
+	if msgs, _ := rack.TakeN(ctx, inbox, 10, time.Second/100); len(msgs) != 1 || msgs[0].ID != kept.ID {
+		t.Fatalf("Unexpected messages for inbox: %v", msgs)
+	}
+	// taking from the other inbox expires its message
+	if msgs, _ := rack.TakeN(ctx, other, 10, time.Second/100); len(msgs) != 0 {
+		t.Fatalf("Message should have expired")
+	}
+	msgs, err := rack.TakeN(ctx, dlq, 10, time.Second/10)
+	if err != nil {
+		t.Fatal(err)
+	}
+	reasons := map[uuid.UUID]string{}
+	for _, m := range msgs {
+		if m.To != dlq {
+			t.Errorf("Dead letter should be addressed to %v got %v", dlq, m.To)
+		}
+		reasons[m.ID] = m.Headers[mailbox.DeadReasonHeader][0]
+	}
+	if !reflect.DeepEqual(reasons, map[uuid.UUID]string{expired.ID: mailbox.ReasonExpired, evicted.ID: mailbox.ReasonEvicted}) {
+		t.Fatalf("Unexpected dead letters: %v", reasons)
+	}
+
+	for _, m := range msgs {
+		if m.ID != expired.ID {
+			continue
+		}
+		redriven, err := mailbox.Redrive(m)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if redriven.To != other || len(redriven.Headers[mailbox.DeadReasonHeader]) != 0 {
+			t.Fatalf("Unexpected redriven message: %#v", redriven)
+		}
+	}
+	if _, err := mailbox.Redrive(evicted); !errors.Is(err, mailbox.ErrNotDeadLetter) {
+		t.Fatalf("Expecting ErrNotDeadLetter got %v", err)
+	}
+}
+
+func TestDeadLetterEvictOldest(t *testing.T) {
+	ctx, cancel := context.WithTimeout(context.Background(), time.Second)
+	defer cancel()
+
+	inbox := mailbox.Address{Node: uuid.Must(uuid.NewRandom())}
+	dlq := mailbox.Address{Node: uuid.Must(uuid.NewRandom())}
+	reader := sdkmetric.NewManualReader()
+	provider := sdkmetric.NewMeterProvider(sdkmetric.WithReader(reader))
+	defer provider.Shutdown(context.Background())
+	rack := mailbox.NewRack(mailbox.WithRetention(2, time.Minute), mailbox.WithOverflow(mailbox.EvictOldest),
+		mailbox.WithDeadLetter(dlq), mailbox.WithDeadLetterLimit(2), mailbox.WithMeterProvider(provider))
+	defer rack.Close()
+	oplog := rack.MessageLog(5)
+
+	var sent []*mailbox.Message
+	for range 5 {
+		msg := &mailbox.Message{ID: uuid.Must(uuid.NewRandom()), To: inbox, SentAt: time.Now()}
+		if err := rack.Deliver(ctx, msg); err != nil {
+			t.Fatal(err)
+		}
+		sent = append(sent, msg)
+		<-oplog
+	}
+
+	// dead letters do not count towards the rack limit, so live messages never evict them,
+	// but only the 2 most recent dead letters are kept
+	if msgs, _ := rack.TakeN(ctx, inbox, 10, time.Second/100); !reflect.DeepEqual(msgs, sent[3:]) {
+		t.Fatalf("Expecting the last 2 messages got %v", len(msgs))
+	}
+	msgs, _ := rack.TakeN(ctx, dlq, 10, time.Second/100)
+	if len(msgs) != 2 {
+		t.Fatalf("Expecting 2 dead letters got %v", len(msgs))
+	}
+	for i, m := range msgs {
+		if m.ID != sent[i+1].ID || m.Headers[mailbox.DeadReasonHeader][0] != mailbox.ReasonEvicted {
+			t.Fatalf("Unexpected dead letter %v: %#v", i, m)
+		}
+	}
+	values := metricValues(t, reader)
+	if values["mailbox.rack.dead_letters"] != 3 || values["mailbox.rack.evicted"] != 4 {
+		t.Fatalf("Expecting 3 dead letters and 4 evicted messages got %v", values)
+	}
+}
+
+func TestDedup(t *testing.T) {
+	ctx, cancel := context.WithTimeout(context.Background(), time.Second)
+	defer cancel()
+
+	inbox := mailbox.Address{Node: uuid.Must(uuid.NewRandom())}
+	rack := mailbox.NewRack(mailbox.WithDedup(2, time.Second/20))
+	defer rack.Close()
+	oplog := rack.MessageLog(10)
+	newMsg := func() *mailbox.Message {
+		return &mailbox.Message{ID: uuid.Must(uuid.NewRandom()), To: inbox, SentAt: time.Now()}
+	}
+	deliver := func(msgs ...*mailbox.Message) {
+		for _, m := range msgs {
+			if err := rack.Deliver(ctx, m); err != nil {
+				t.Fatal(err)
+			}
+		}
+	}
+	// count waits until the rack processed n messages and takes all of them
+	count := func(n int) int {
+		for range n {
+			<-oplog
+		}
+		msgs, err := rack.TakeN(ctx, inbox, 10, time.Second/100)
+		if err != nil {
+			t.Fatal(err)
+		}
+		return len(msgs)
+	}
+
+	a, b, c := newMsg(), newMsg(), newMsg()
+	deliver(a, a, b, a)
+	if n := count(2); n != 2 {
+		t.Fatalf("Duplicates should not be delivered, got %v messages", n)
+	}
+	// c pushes a out of the window
+	deliver(c, a)
+	if n := count(2); n != 2 {
+		t.Fatalf("Messages outside the window should be delivered, got %v messages", n)
+	}
+	time.Sleep(time.Second / 20)
+	deliver(c)
+	if n := count(1); n != 1 {
+		t.Fatalf("Expired entries should be delivered, got %v messages", n)
+	}
+	// messages without an ID are not duplicates of each other
+	deliver(&mailbox.Message{To: inbox, SentAt: time.Now()}, &mailbox.Message{To: inbox, SentAt: time.Now()})
+	if n := count(2); n != 2 {
+		t.Fatalf("Messages without an ID should be delivered, got %v messages", n)
+	}
+}
+
+func TestDeliverAfter(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "rack.db")
+	rack, err := mailbox.NewDurableRack(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	ctx, cancel := context.WithTimeout(context.Background(), time.Second)
+	defer cancel()
+
+	inbox := mailbox.Address{Node: uuid.Must(uuid.NewRandom())}
+	due := time.Now().Add(time.Second / 10)
+	later := &mailbox.Message{ID: uuid.Must(uuid.NewRandom()), To: inbox, SentAt: time.Now()}
+	mailbox.DeliverAfter(later, due)
+	cancelled := &mailbox.Message{ID: uuid.Must(uuid.NewRandom()), To: inbox, SentAt: time.Now()}
+	mailbox.DeliverAfter(cancelled, due)
+	for _, m := range []*mailbox.Message{later, cancelled} {
+		if err := rack.Deliver(ctx, m); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if err := rack.Cancel(ctx, uuid.Must(uuid.NewRandom()), cancelled.ID); !errors.Is(err, mailbox.ErrNotScheduled) {
+		t.Fatalf("Messages should only be cancelled from their inbox, got %v", err)
+	}
+	if err := rack.Cancel(ctx, inbox.Node, cancelled.ID); err != nil {
+		t.Fatal(err)
+	}
+	if err := rack.Cancel(ctx, inbox.Node, cancelled.ID); !errors.Is(err, mailbox.ErrNotScheduled) {
+		t.Fatalf("Expecting ErrNotScheduled got %v", err)
+	}
+	if msgs, _ := rack.TakeN(ctx, inbox, 10, time.Second/100); len(msgs) != 0 {
+		t.Fatalf("Scheduled message should not be visible before %v", due)
+	}
+
+	// scheduled messages survive a restart
+	rack.Close()
+	rack, err = mailbox.NewDurableRack(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer rack.Close()
+	msgs, err := rack.TakeN(ctx, inbox, 10, time.Second/2)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(msgs) != 1 || msgs[0].ID != later.ID {
+		t.Fatalf("Unexpected messages %v", msgs)
+	} else if time.Now().Before(due) {
+		t.Fatalf("Message delivered before %v", due)
+	}
+
+	invalid := &mailbox.Message{ID: uuid.Must(uuid.NewRandom()), To: inbox, SentAt: time.Now(),
+		Headers: map[string][]string{mailbox.DeliverAfterHeader: {"tomorrow"}}}
+	if err := rack.Deliver(ctx, invalid); !errors.Is(err, mailbox.ErrInvalidDeliverAfter) {
+		t.Fatalf("Expecting ErrInvalidDeliverAfter got %v", err)
+	}
+	tooLate := &mailbox.Message{ID: uuid.Must(uuid.NewRandom()), To: inbox, SentAt: time.Now()}
+	mailbox.DeliverAfter(tooLate, time.Now().Add(48*time.Hour))
+	if err := rack.Deliver(ctx, tooLate); !errors.Is(err, mailbox.ErrInvalidDeliverAfter) {
+		t.Fatalf("Messages beyond the schedule horizon should be rejected, got %v", err)
+	}
+}
+
+func TestScheduleOverflow(t *testing.T) {
+	ctx, cancel := context.WithTimeout(context.Background(), time.Second)
+	defer cancel()
+	inbox := mailbox.Address{Node: uuid.Must(uuid.NewRandom())}
+	other := mailbox.Address{Node: uuid.Must(uuid.NewRandom())}
+	scheduled := func(to mailbox.Address) *mailbox.Message {
+		msg := &mailbox.Message{ID: uuid.Must(uuid.NewRandom()), To: to, SentAt: time.Now()}
+		mailbox.DeliverAfter(msg, time.Now().Add(time.Minute))
+		return msg
+	}
+
+	// scheduled messages are dropped like any other message
+	dlq := mailbox.Address{Node: uuid.Must(uuid.NewRandom())}
+	rack := mailbox.NewRack(mailbox.WithRetention(1, time.Minute), mailbox.WithDeadLetter(dlq))
+	defer rack.Close()
+	for range 2 {
+		if err := rack.Deliver(ctx, scheduled(inbox)); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if msgs, _ := rack.TakeN(ctx, dlq, 10, time.Second/10); len(msgs) != 1 || msgs[0].Headers[mailbox.DeadReasonHeader][0] != mailbox.ReasonEvicted {
+		t.Fatalf("Expecting one evicted message got %v", msgs)
+	}
+
+	// and they count towards the inbox depth
+	rack = mailbox.NewRack(mailbox.WithInboxDepth(1), mailbox.WithOverflow(mailbox.RejectNew))
+	defer rack.Close()
+	if err := rack.Deliver(ctx, scheduled(inbox)); err != nil {
+		t.Fatal(err)
+	}
+	if err := rack.Deliver(ctx, scheduled(inbox)); !errors.Is(err, mailbox.ErrRackFull) {
+		t.Fatalf("Expecting ErrRackFull got %v", err)
+	}
+	if err := rack.Deliver(ctx, &mailbox.Message{ID: uuid.Must(uuid.NewRandom()), To: inbox, SentAt: time.Now()}); !errors.Is(err, mailbox.ErrRackFull) {
+		t.Fatalf("Expecting ErrRackFull got %v", err)
+	}
+	if err := rack.Deliver(ctx, scheduled(other)); err != nil {
+		t.Fatal(err)
+	}
+}
+
+func TestCompetingConsumers(t *testing.T) {
+	reader := sdkmetric.NewManualReader()
+	provider := sdkmetric.NewMeterProvider(sdkmetric.WithReader(reader))
+	defer provider.Shutdown(context.Background())
+	rack := mailbox.NewRack(mailbox.WithMeterProvider(provider))
+	defer rack.Close()
+	ctx, cancel := context.WithTimeout(context.Background(), time.Second*5)
+	defer cancel()
+
+	// waitQueued returns once n consumers are waiting for messages
+	waitQueued := func(n int64) {
+		for {
+			var rm metricdata.ResourceMetrics
+			if err := reader.Collect(ctx, &rm); err != nil {
+				t.Fatal(err)
+			}
+			for _, sm := range rm.ScopeMetrics {
+				for _, m := range sm.Metrics {
+					if g, ok := m.Data.(metricdata.Gauge[int64]); ok && m.Name == "mailbox.rack.waiting_consumers" && g.DataPoints[0].Value == n {
+						return
+					}
+				}
+			}
+			select {
+			case <-ctx.Done():
+				t.Fatalf("Consumers are not waiting: %v", ctx.Err())
+			case <-time.After(time.Millisecond):
+			}
+		}
+	}
+
+	const workers, rounds = 4, 25
+	inbox := mailbox.Address{Node: uuid.Must(uuid.NewRandom())}
+	received := make(chan int)
+	for w := range workers {
+		go func() {
+			for {
+				if _, err := rack.TakeAddress(ctx, inbox); err != nil {
+					return
+				}
+				select {
+				case received <- w:
+				case <-ctx.Done():
+					return
+				}
+			}
+		}()
+	}
+	deliver := func() int {
+		// only consumers which are waiting take turns, so wait for every worker
+		// to come back before sending the next message
+		waitQueued(workers)
+		msg := &mailbox.Message{ID: uuid.Must(uuid.NewRandom()), To: inbox, SentAt: time.Now()}
+		if err := rack.Deliver(ctx, msg); err != nil {
+			t.Fatal(err)
+		}
+		select {
+		case w := <-received:
+			return w
+		case <-ctx.Done():
+			t.Fatal("Message was not taken, consumers were dropped without a message")
+			return -1
+		}
+	}
+
+	// the first round decides the order, after that every worker gets one message per round
+	order := make([]int, workers)
+	counts := make([]int, workers)
+	for i := range workers * rounds {
+		w := deliver()
+		counts[w]++
+		if i < workers {
+			order[i] = w
+		} else if w != order[i%workers] {
+			t.Fatalf("Message %v should go to worker %v got %v (order %v)", i, order[i%workers], w, order)
+		}
+	}
+	for w, n := range counts {
+		if n != rounds {
+			t.Fatalf("Worker %v took %v messages, expecting %v: %v", w, n, rounds, counts)
+		}
+	}
+}
+
+func TestAbandonedTakes(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "rack.db")
+	rack, err := mailbox.NewDurableRack(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer func() { rack.Close() }()
+	ctx, cancel := context.WithTimeout(context.Background(), time.Second*5)
+	defer cancel()
+
+	const workers, total = 4, 500
+	inbox := mailbox.Address{Node: uuid.Must(uuid.NewRandom())}
+	oplog := rack.MessageLog(total)
+	received := make(chan uuid.UUID, total)
+	stop := make(chan struct{})
+	var wg sync.WaitGroup
+	for range workers {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for {
+				select {
+				case <-stop:
+					return
+				default:
+				}
+				// most takes give up while messages are being handed out
+				takeCtx, cancel := context.WithTimeout(ctx, time.Microsecond*50)
+				msg, err := rack.TakeAddress(takeCtx, inbox)
+				cancel()
+				if err == nil {
+					received <- msg.ID
+				}
+			}
+		}()
+	}
+	for i := 0; i < total; i++ {
+		if err := rack.Deliver(ctx, &mailbox.Message{ID: uuid.Must(uuid.NewRandom()), To: inbox, SentAt: time.Now()}); err != nil {
+			t.Fatal(err)
+		}
+	}
+	for range total {
+		<-oplog
+	}
+	close(stop)
+	wg.Wait()
+	// messages are only removed from the journal once a consumer received them
+	rack.Close()
+	rack, err = mailbox.NewDurableRack(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	rest, err := rack.TakeN(ctx, inbox, total, 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, m := range rest {
+		received <- m.ID
+	}
+	close(received)
+	seen := map[uuid.UUID]bool{}
+	for id := range received {
+		if seen[id] {
+			t.Fatalf("Message %v taken twice", id)
+		}
+		seen[id] = true
+	}
+	if len(seen) != total {
+		t.Fatalf("Expecting %v messages got %v", total, len(seen))
+	}
+}
+
+func TestTracing(t *testing.T) {
+	recorder := tracetest.NewSpanRecorder()
+	tp := sdktrace.NewTracerProvider(sdktrace.WithSpanProcessor(recorder))
+	defer tp.Shutdown(context.Background())
+	rack := mailbox.NewRack(mailbox.WithTracerProvider(tp))
+	defer rack.Close()
+	ctx, cancel := context.WithTimeout(context.Background(), time.Second)
+	defer cancel()
+
+	oplog := rack.MessageLog(1)
+	ctx, parent := tp.Tracer("test").Start(ctx, "request")
+	inbox := mailbox.Address{Node: uuid.Must(uuid.NewRandom())}
+	msg := &mailbox.Message{ID: uuid.Must(uuid.NewRandom()), To: inbox, SentAt: time.Now()}
+	if err := rack.Deliver(ctx, msg); err != nil {
+		t.Fatal(err)
+	}
+	parent.End()
+	// wait until the message is parked
+	<-oplog
+	if len(msg.Headers["Traceparent"]) == 0 {
+		t.Fatalf("Trace context should be stored in the message headers: %v", msg.Headers)
+	}
+	// the consumer has its own trace, the take span continues the trace of the message
+	taken, err := rack.TakeAddress(context.Background(), inbox)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if got := trace.SpanContextFromContext(mailbox.ExtractTraceContext(context.Background(), taken)).TraceID(); got != parent.SpanContext().TraceID() {
+		t.Fatalf("Expecting trace %v got %v", parent.SpanContext().TraceID(), got)
+	}
+
+	names := map[string]bool{}
+	for _, span := range recorder.Ended() {
+		if span.SpanContext().TraceID() != parent.SpanContext().TraceID() {
+			t.Errorf("Span %v is not part of the trace", span.Name())
+		}
+		names[span.Name()] = true
+	}
+	for _, name := range []string{"request", "mailbox.deliver", "mailbox.park", "mailbox.take"} {
+		if !names[name] {
+			t.Errorf("Missing span %v, got %v", name, names)
+		}
+	}
+}
+
+func TestTracingDuplicates(t *testing.T) {
+	tp := sdktrace.NewTracerProvider()
+	defer tp.Shutdown(context.Background())
+	rack := mailbox.NewRack(mailbox.WithTracerProvider(tp), mailbox.WithDedup(10, time.Minute))
+	defer rack.Close()
+	ctx, cancel := context.WithTimeout(context.Background(), time.Second)
+	defer cancel()
+	ctx, parent := tp.Tracer("test").Start(ctx, "request")
+	defer parent.End()
+
+	inbox := mailbox.Address{Node: uuid.Must(uuid.NewRandom())}
+	headers := map[string][]string{"Kind": {"test"}}
+	msg := &mailbox.Message{ID: uuid.Must(uuid.NewRandom()), To: inbox, SentAt: time.Now(), Headers: headers}
+	if err := rack.Deliver(ctx, msg); err != nil {
+		t.Fatal(err)
+	}
+	taken, err := rack.TakeAddress(ctx, inbox)
+	if err != nil {
+		t.Fatal(err)
+	}
+	done := make(chan struct{})
+	go func() {
+		defer close(done)
+		for range 100 {
+			mailbox.ExtractTraceContext(context.Background(), taken)
+		}
+	}()
+	// retries of an accepted message must not touch it while the consumer reads it
+	if err := rack.Deliver(ctx, msg); err != nil {
+		t.Fatal(err)
+	}
+	<-done
+	if len(headers) != 1 {
+		t.Fatalf("The headers of the caller should not be modified: %v", headers)
+	}
+}
+
+func TestSenderLimits(t *testing.T) {
+	rack := mailbox.NewRack(mailbox.WithSenderLimits(mailbox.RateLimit{Rate: 10, Burst: 2}, mailbox.Quota(3, time.Hour)))
+	defer rack.Close()
+	ctx, cancel := context.WithTimeout(context.Background(), time.Second)
+	defer cancel()
+
+	inbox := mailbox.Address{Node: uuid.Must(uuid.NewRandom())}
+	deliver := func(ctx context.Context, from uuid.UUID) error {
+		return rack.Deliver(ctx, &mailbox.Message{ID: uuid.Must(uuid.NewRandom()), From: mailbox.Address{Node: from}, To: inbox, SentAt: time.Now()})
+	}
+	noisy, quiet := uuid.Must(uuid.NewRandom()), uuid.Must(uuid.NewRandom())
+	for range 2 {
+		if err := deliver(ctx, noisy); err != nil {
+			t.Fatal(err)
+		}
+	}
+	var limited *mailbox.RateLimitError
+	if err := deliver(ctx, noisy); !errors.As(err, &limited) || !errors.Is(err, mailbox.ErrRateLimited) {
+		t.Fatalf("Expecting RateLimitError got %v", err)
+	} else if limited.RetryAfter <= 0 || limited.RetryAfter > time.Second/10 {
+		t.Fatalf("Unexpected retry after %v", limited.RetryAfter)
+	}
+	if err := deliver(ctx, quiet); err != nil {
+		t.Fatalf("Other senders should not be limited, got %v", err)
+	}
+
+	time.Sleep(limited.RetryAfter)
+	if err := deliver(ctx, noisy); err != nil {
+		t.Fatalf("Sender should be allowed after %v, got %v", limited.RetryAfter, err)
+	}
+	// the hourly quota is exhausted now
+	time.Sleep(time.Second / 5)
+	if err := deliver(ctx, noisy); !errors.As(err, &limited) || limited.RetryAfter < time.Minute {
+		t.Fatalf("Expecting quota to be exhausted, got %v", err)
+	}
+
+	// the identity in ctx takes precedence over From.Node
+	keyed := mailbox.WithSender(ctx, "token:worker")
+	for range 2 {
+		if err := deliver(keyed, uuid.Must(uuid.NewRandom())); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if err := deliver(keyed, uuid.Must(uuid.NewRandom())); !errors.Is(err, mailbox.ErrRateLimited) {
+		t.Fatalf("Expecting ErrRateLimited got %v", err)
+	}
+}
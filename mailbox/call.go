@@ -0,0 +1,57 @@
+package mailbox
+
+import (
+	"context"
+	"log/slog"
+	"time"
+
+	"github.com/google/uuid"
+)
+
+type (
+	// DeliverFunc sends a message to a rack
+	DeliverFunc func(ctx context.Context, msg *Message) error
+	// TakeFunc waits for the next message addressed to inbox
+	TakeFunc func(ctx context.Context, inbox uuid.UUID) (*Message, error)
+)
+
+// Call delivers msg using t and waits until a message whose ReplyTo
+// matches msg.ID arrives at the inbox of msg.From.
+//
+// See CallFunc for details.
+func Call(ctx context.Context, t Transport, msg *Message) (*Message, error) {
+	return CallFunc(ctx, msg, t.Deliver, func(ctx context.Context, inbox uuid.UUID) (*Message, error) {
+		return t.TakeAddress(ctx, Address{Node: inbox})
+	})
+}
+
+// CallFunc implements the request/reply pattern on top of any pair of
+// deliver/take functions.
+//
+// If msg has no ID or SentAt, CallFunc fills them before sending. Messages arriving
+// at the caller inbox which are not a reply to msg are discarded, so it should
+// only be used with inboxes which are dedicated to receive replies.
+//
+// CallFunc waits until ctx is done, use context.WithTimeout to limit how long
+// the caller is willing to wait for a reply.
+func CallFunc(ctx context.Context, msg *Message, deliver DeliverFunc, take TakeFunc) (*Message, error) {
+	if msg.ID == uuid.Nil {
+		msg.ID = uuid.Must(uuid.NewRandom())
+	}
+	if msg.SentAt.IsZero() {
+		msg.SentAt = time.Now().Round(0)
+	}
+	if err := deliver(ctx, msg); err != nil {
+		return nil, err
+	}
+	for {
+		reply, err := take(ctx, msg.From.Node)
+		if err != nil {
+			return nil, err
+		}
+		if reply.ReplyTo == msg.ID {
+			return reply, nil
+		}
+		slog.DebugContext(ctx, "Discarding stray message while waiting for reply", "messageId", reply.ID, "replyTo", reply.ReplyTo, "expectedReplyTo", msg.ID)
+	}
+}
@@ -0,0 +1,120 @@
+package mailbox
+
+import (
+	"context"
+	"errors"
+	"log/slog"
+	"maps"
+	"time"
+)
+
+const (
+	// DeadReasonHeader says why a message was sent to the dead-letter address
+	DeadReasonHeader = "Mailbox-Dead-Reason"
+	// OriginalToHeader contains the original recipient of a dead letter (see Address.String)
+	OriginalToHeader = "Mailbox-Original-To"
+
+	// ReasonExpired is used for messages which were not taken before they expired
+	ReasonExpired = "expired"
+	// ReasonEvicted is used for messages removed because the rack (or inbox) was full
+	ReasonEvicted = "evicted"
+)
+
+var ErrNotDeadLetter = errors.New("message is not a dead letter")
+
+// WithDeadLetter routes expired and evicted messages to addr, where they can be
+// taken like any other message. Dead letters carry DeadReasonHeader and OriginalToHeader,
+// see Redrive.
+//
+// Dead letters are kept for the rack TTL (see WithRetention) and are dropped once they
+// expire, they are not subject to the rack (or inbox) limits but to their own,
+// see WithDeadLetterLimit.
+func WithDeadLetter(addr Address) Option {
+	return func(r *Rack) {
+		r.deadLetterTo = &addr
+	}
+}
+
+// WithDeadLetterLimit sets how many dead letters the rack keeps parked, once the limit
+// is reached the oldest dead letter is dropped to make room for a new one.
+// Defaults to the rack limit (see WithRetention)
+func WithDeadLetterLimit(n int) Option {
+	return func(r *Rack) {
+		r.maxDead = n
+	}
+}
+
+// Redrive returns a copy of dead addressed to its original recipient,
+// without the dead-letter headers, so it can be delivered again
+func Redrive(dead *Message) (*Message, error) {
+	v := dead.Headers[OriginalToHeader]
+	if len(v) == 0 {
+		return nil, ErrNotDeadLetter
+	}
+	to, err := ParseAddress(v[0])
+	if err != nil {
+		return nil, err
+	}
+	msg := *dead
+	msg.To = to
+	msg.Headers = maps.Clone(dead.Headers)
+	delete(msg.Headers, OriginalToHeader)
+	delete(msg.Headers, DeadReasonHeader)
+	return &msg, nil
+}
+
+// deadLetter sends a copy of e to the dead-letter address, if configured
+func (l *rackLoop) deadLetter(e entry, reason string) {
+	if l.deadLetterTo == nil {
+		return
+	}
+	if _, dead := e.msg.Headers[DeadReasonHeader]; dead {
+		return
+	}
+	msg := *e.msg
+	msg.To = *l.deadLetterTo
+	msg.Headers = maps.Clone(e.msg.Headers)
+	if msg.Headers == nil {
+		msg.Headers = map[string][]string{}
+	}
+	msg.Headers[DeadReasonHeader] = []string{reason}
+	msg.Headers[OriginalToHeader] = []string{e.msg.To.String()}
+	l.metrics.add(l.metrics.deadLetters)
+	// the TTL and schedule of the original message do not apply to the dead letter
+	delete(msg.Headers, TTLHeader)
+	delete(msg.Headers, DeliverAfterHeader)
+
+	dl := entry{msg: &msg, expire: time.Now().Add(l.ttl), offset: e.offset, dead: true}
+	var err error
+	dl.seq, err = l.journal.append(context.Background(), dl.msg, dl.expire)
+	if err != nil {
+		slog.Error("Unable to store dead letter in journal", "messageId", msg.ID, "error", err)
+	}
+	if l.dispatch(dl) {
+		return
+	}
+	// dead letters are not subject to the rack limits, otherwise they could
+	// evict live messages, instead the oldest dead letter makes room for dl
+	if l.parked.dead >= l.deadLimit() {
+		if old, found := l.parked.evictDead(dl.msg.To.Node); found {
+			l.metrics.add(l.metrics.evicted)
+			l.forget(old)
+		}
+	}
+	l.parked.push(dl)
+	l.metrics.add(l.metrics.parked)
+}
+
+func (r *Rack) deadLimit() int {
+	if r.maxDead > 0 {
+		return r.maxDead
+	}
+	return r.maxParked
+}
+
+// isDeadLetter reports if msg is a dead letter created by the rack,
+// used to restore dead letters from the journal
+func (l *rackLoop) isDeadLetter(msg *Message) bool {
+	_, dead := msg.Headers[DeadReasonHeader]
+	return dead && l.deadLetterTo != nil && msg.To == *l.deadLetterTo
+}
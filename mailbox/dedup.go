@@ -0,0 +1,87 @@
+package mailbox
+
+import (
+	"sync"
+	"time"
+
+	"github.com/google/uuid"
+)
+
+type (
+	// dedupWindow remembers the most recent message IDs accepted by the rack,
+	// bounded by size and by age
+	dedupWindow struct {
+		l     sync.Mutex
+		size  int
+		span  time.Duration
+		seen  map[uuid.UUID]time.Time
+		order []uuid.UUID
+	}
+)
+
+// WithDedup makes the rack remember the IDs of the last size messages it accepted
+// for up to span. A message whose ID is still in the window is acknowledged
+// (Deliver returns nil) but it is not delivered again. Messages without an ID
+// (uuid.Nil) cannot be told apart, so they are always delivered.
+//
+// The window is kept in memory, so it does not survive a restart of the rack.
+func WithDedup(size int, span time.Duration) Option {
+	return func(r *Rack) {
+		if size <= 0 || span <= 0 {
+			r.dedup = nil
+			return
+		}
+		r.dedup = &dedupWindow{size: size, span: span, seen: make(map[uuid.UUID]time.Time)}
+	}
+}
+
+// claim records id as seen at now, returns false if id was already in the window.
+// The nil id is never recorded
+func (d *dedupWindow) claim(id uuid.UUID, now time.Time) bool {
+	if id == uuid.Nil {
+		return true
+	}
+	d.l.Lock()
+	defer d.l.Unlock()
+	d.trim(now)
+	if _, found := d.seen[id]; found {
+		return false
+	}
+	d.seen[id] = now
+	d.order = append(d.order, id)
+	if len(d.order) > d.size {
+		delete(d.seen, d.order[0])
+		d.order = d.order[1:]
+	}
+	return true
+}
+
+// release removes id from the window, used when the rack could not accept
+// the message, so the sender can retry it
+func (d *dedupWindow) release(id uuid.UUID) {
+	d.l.Lock()
+	defer d.l.Unlock()
+	if _, found := d.seen[id]; !found {
+		return
+	}
+	delete(d.seen, id)
+	for i, v := range d.order {
+		if v == id {
+			d.order = append(d.order[:i], d.order[i+1:]...)
+			break
+		}
+	}
+}
+
+// trim removes the ids which are older than the window span
+func (d *dedupWindow) trim(now time.Time) {
+	n := 0
+	for _, id := range d.order {
+		if now.Sub(d.seen[id]) < d.span {
+			break
+		}
+		delete(d.seen, id)
+		n++
+	}
+	d.order = d.order[n:]
+}
@@ -8,22 +8,58 @@
 // connected to one or more rack instances at the same time and there is no requirement
 // that each rack instance talks to each other.
 //
+// Racks can optionally forward messages to each other, by using a Registry
+// which maps a node to its home rack (see WithRegistry).
+//
+// Messages carry W3C trace context (traceparent/tracestate) in their headers, so a request
+// which hops across actors is reported as a single trace. The rack reports spans to the
+// provider given to WithTracerProvider (or the global one), nothing is exported unless
+// the application configures an exporter.
+//
+// Code which sends or takes messages should depend on Transport, which is implemented
+// by the Rack itself and by the remote clients (see the api and rpc packages).
+//
+// Within a single rack, messages for the same inbox are handed to consumers in the
+// order the rack accepted them (the order in which calls to Rack.Deliver returned).
+// Messages which arrive while no consumer is waiting are parked in a FIFO queue per inbox
+// until a consumer takes them or they expire. Expired or evicted messages can be kept
+// in a dead-letter inbox instead (see WithDeadLetter).
+// Messages with the DeliverAfterHeader stay invisible until the given time and can be
+// cancelled with Rack.Cancel before that.
+//
+// Several consumers can wait on the same inbox, each message is handed to exactly one
+// of them, starting with the consumer which has been waiting the longest, so consumers
+// which keep taking from the inbox receive messages in turns.
+//
 // There is a possibility that the same message might be delivered more than once
-// to the same actor (replication or durable storage), it is up to the actor
-// to de-duplicate such messages.
+// to the same actor (replication, durable storage or expired leases), it is up to the actor
+// to de-duplicate such messages. Racks can ignore messages whose ID they accepted
+// recently (see WithDedup), which covers senders retrying after a timeout.
 //
-// To help with that, each message contains a field to indicate when it first arrived
-// at a specific rack, and senders MUST also provide a time stamp when they send messages.
+// To help with that, each message contains a field (ArrivedAt) to indicate when it first arrived
+// at a specific rack, and senders MUST also provide a time stamp (SentAt) when they send messages.
 // During subscription, actors can specify filters to reduce how much traffic flows from
 // the rack to the actor.
 //
+// Racks can limit how many messages each sender delivers (see WithSenderLimits),
+// so a single producer cannot fill the rack for everyone else.
+//
+// Consumers which cannot afford to lose messages should use Rack.TakeLease and
+// acknowledge each message with Rack.Ack after processing it, messages which are not
+// acknowledged within the lease timeout become visible again.
+//
 // Messages might be of two types:
 //   - Request/Replay pair, the rack will not control if a given pair is valid, therefore
 //     an actor might receive a Replay for a message that was never sent. Actors should maintain
 //     internal state to handle such scenarios. As well as timeout replies that were never received.
 //   - Notification where no response is expected on the other hand
 //
-// The mailbox package does not implement any special process for those types of messages,
-// although it DOES specify some of those fields. A message for a unknown address might be
+// An inbox can also be used as a topic, in which case each message sent to it is copied
+// to every subscribed address (see Rack.Join).
+//
+// The rack does not implement any special process for those types of messages,
+// although it DOES specify some of those fields. Call (and CallFunc) implement the
+// Request/Reply pattern on the client side, by waiting for a message whose ReplyTo
+// matches the ID of the request. A message for a unknown address might be
 // silently dropped if there are no registered consumers for it.
 package mailbox
@@ -0,0 +1,61 @@
+package mailbox
+
+import (
+	"slices"
+
+	"github.com/google/uuid"
+)
+
+type (
+	// Filter selects which messages are sent to a MessageLog follower.
+	//
+	// Zero valued fields match any message, so Filter{} matches everything.
+	Filter struct {
+		// To matches the recipient address, a zero Node or Process
+		// matches any value
+		To Address
+		// From matches the sender address, a zero Node or Process
+		// matches any value
+		From Address
+		// HeaderMatch requires that each key is present in the message
+		// headers and that one of its values is equal to the given value
+		HeaderMatch map[string]string
+	}
+)
+
+// Match returns true if msg is accepted by the filter
+func (f Filter) Match(msg *Message) bool {
+	if !f.To.match(msg.To) || !f.From.match(msg.From) {
+		return false
+	}
+	for k, v := range f.HeaderMatch {
+		if !slices.Contains(msg.Headers[k], v) {
+			return false
+		}
+	}
+	return true
+}
+
+func (a Address) match(other Address) bool {
+	if a.Node != uuid.Nil && a.Node != other.Node {
+		return false
+	}
+	if a.Process != 0 && a.Process != other.Process {
+		return false
+	}
+	return true
+}
+
+// matchAny returns true if msg is accepted by at least one filter,
+// or if filters is empty
+func matchAny(filters []Filter, msg *Message) bool {
+	if len(filters) == 0 {
+		return true
+	}
+	for _, f := range filters {
+		if f.Match(msg) {
+			return true
+		}
+	}
+	return false
+}
@@ -0,0 +1,118 @@
+package mailbox
+
+import (
+	"context"
+	"database/sql"
+	"errors"
+	"time"
+
+	_ "github.com/mattn/go-sqlite3"
+)
+
+type (
+	// journal keeps a copy of every message accepted by a rack
+	// until a consumer receives the message
+	journal interface {
+		append(ctx context.Context, msg *Message, expire time.Time) (int64, error)
+		remove(seq int64) error
+		pending(ctx context.Context, now time.Time) ([]entry, error)
+		// reserve stores the highest offset the log can assign before
+		// calling reserve again, so offsets keep growing after a restart
+		reserve(offset uint64) error
+		reserved(ctx context.Context) (uint64, error)
+		Close() error
+	}
+
+	nopJournal struct{}
+
+	sqlJournal struct {
+		db *sql.DB
+	}
+)
+
+func (nopJournal) append(context.Context, *Message, time.Time) (int64, error) { return 0, nil }
+func (nopJournal) remove(int64) error                                         { return nil }
+func (nopJournal) pending(context.Context, time.Time) ([]entry, error)        { return nil, nil }
+func (nopJournal) reserve(uint64) error                                       { return nil }
+func (nopJournal) reserved(context.Context) (uint64, error)                   { return 0, nil }
+func (nopJournal) Close() error                                               { return nil }
+
+func openJournal(ctx context.Context, path string) (*sqlJournal, error) {
+	conn, err := sql.Open("sqlite3", path+"?_journal_mode=WAL&_busy_timeout=5000")
+	if err != nil {
+		return nil, err
+	}
+	_, err = conn.ExecContext(ctx, `create table if not exists t_messages(seq integer primary key autoincrement, content blob not null, expires_at integer not null)`)
+	if err != nil {
+		conn.Close()
+		return nil, err
+	}
+	_, err = conn.ExecContext(ctx, `create table if not exists t_offsets(id integer primary key check (id = 0), reserved integer not null)`)
+	if err != nil {
+		conn.Close()
+		return nil, err
+	}
+	return &sqlJournal{db: conn}, nil
+}
+
+func (j *sqlJournal) append(ctx context.Context, msg *Message, expire time.Time) (int64, error) {
+	buf, err := msg.MarshalMsg(nil)
+	if err != nil {
+		return 0, err
+	}
+	res, err := j.db.ExecContext(ctx, `insert into t_messages(content, expires_at) values (?, ?)`, buf, expire.UnixNano())
+	if err != nil {
+		return 0, err
+	}
+	return res.LastInsertId()
+}
+
+func (j *sqlJournal) remove(seq int64) error {
+	_, err := j.db.Exec(`delete from t_messages where seq = ?`, seq)
+	return err
+}
+
+func (j *sqlJournal) pending(ctx context.Context, now time.Time) ([]entry, error) {
+	_, err := j.db.ExecContext(ctx, `delete from t_messages where expires_at < ?`, now.UnixNano())
+	if err != nil {
+		return nil, err
+	}
+	rows, err := j.db.QueryContext(ctx, `select seq, content, expires_at from t_messages order by seq`)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+	var out []entry
+	for rows.Next() {
+		var buf []byte
+		var expire int64
+		e := entry{msg: &Message{}}
+		if err := rows.Scan(&e.seq, &buf, &expire); err != nil {
+			return nil, err
+		}
+		if _, err := e.msg.UnmarshalMsg(buf); err != nil {
+			return nil, err
+		}
+		e.expire = time.Unix(0, expire)
+		out = append(out, e)
+	}
+	return out, rows.Err()
+}
+
+func (j *sqlJournal) reserve(offset uint64) error {
+	_, err := j.db.Exec(`insert into t_offsets(id, reserved) values (0, ?) on conflict(id) do update set reserved = excluded.reserved`, int64(offset))
+	return err
+}
+
+func (j *sqlJournal) reserved(ctx context.Context) (uint64, error) {
+	var offset int64
+	err := j.db.QueryRowContext(ctx, `select reserved from t_offsets where id = 0`).Scan(&offset)
+	if errors.Is(err, sql.ErrNoRows) {
+		return 0, nil
+	}
+	return uint64(offset), err
+}
+
+func (j *sqlJournal) Close() error {
+	return j.db.Close()
+}
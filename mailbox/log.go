@@ -0,0 +1,135 @@
+package mailbox
+
+import (
+	"context"
+	"log/slog"
+	"slices"
+)
+
+// offsetBlock is how many offsets are reserved in the journal at once
+const offsetBlock = 1024
+
+type (
+	tail struct {
+		from     uint64
+		output   chan LogEntry
+		filters  []Filter
+		snapshot chan []LogEntry
+	}
+)
+
+// WithLogHistory sets how many entries of the message log are kept
+// in memory for Tail, defaults to 1000
+func WithLogHistory(n int) Option {
+	return func(r *Rack) {
+		r.logHistory = max(n, 0)
+	}
+}
+
+// Tail returns the message log starting at offset from, followed by every message
+// delivered to the rack until ctx is done. Filters work as in MessageLog.
+//
+// Only the last entries of the log are kept (see WithLogHistory), if from is older than
+// that, Tail starts at the oldest entry available. Like MessageLog, live entries which
+// do not fit in the buffer are dropped, consumers can detect that by looking for gaps
+// between offsets and resume with a new call to Tail.
+func (r *Rack) Tail(ctx context.Context, from uint64, buf int, filters ...Filter) <-chan LogEntry {
+	if buf <= 0 {
+		buf = 1
+	}
+	t := tail{
+		from:     from,
+		output:   make(chan LogEntry, buf),
+		filters:  slices.Clone(filters),
+		snapshot: make(chan []LogEntry, 1),
+	}
+	out := make(chan LogEntry, buf)
+	select {
+	case r.newTail <- t:
+	case <-r.closed:
+		close(out)
+		return out
+	case <-ctx.Done():
+		close(out)
+		return out
+	}
+	snapshot := <-t.snapshot
+	go func() {
+		defer close(out)
+		defer func() {
+			select {
+			case r.dropTail <- t.output:
+			case <-r.closed:
+			}
+		}()
+		for _, e := range snapshot {
+			select {
+			case out <- e:
+			case <-ctx.Done():
+				return
+			}
+		}
+		for {
+			select {
+			case e, ok := <-t.output:
+				if !ok {
+					return
+				}
+				select {
+				case out <- e:
+				case <-ctx.Done():
+					return
+				}
+			case <-ctx.Done():
+				return
+			}
+		}
+	}()
+	return out
+}
+
+// record appends m to the message log and sends it to every tail
+func (l *rackLoop) record(m *Message) {
+	l.offset++
+	if l.offset > l.reserved {
+		l.reserveOffsets()
+	}
+	e := LogEntry{Offset: l.offset, Message: m}
+	if l.logHistory > 0 {
+		if len(l.history) == l.logHistory {
+			l.history[0] = LogEntry{}
+			l.history = l.history[1:]
+		}
+		l.history = append(l.history, e)
+	}
+	for output, filters := range l.tails {
+		if matchAny(filters, m) {
+			select {
+			case output <- e:
+			default:
+				l.metrics.add(l.metrics.followerDropped)
+			}
+		}
+	}
+}
+
+// reserveOffsets stores the next block of offsets in the journal, after a restart
+// the log continues from the end of the block, skipping the offsets which were not used
+func (l *rackLoop) reserveOffsets() {
+	l.reserved = l.offset + offsetBlock - 1
+	if err := l.journal.reserve(l.reserved); err != nil {
+		slog.Error("Unable to reserve message log offsets in journal", "offset", l.reserved, "error", err)
+	}
+}
+
+// addTail registers t and sends the entries it should replay
+func (l *rackLoop) addTail(t tail) {
+	var snapshot []LogEntry
+	for _, e := range l.history {
+		if e.Offset >= t.from && matchAny(t.filters, e.Message) {
+			snapshot = append(snapshot, e)
+		}
+	}
+	l.tails[t.output] = t.filters
+	t.snapshot <- snapshot
+}
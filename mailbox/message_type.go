@@ -1,21 +1,78 @@
 package mailbox
 
-import "github.com/google/uuid"
+import (
+	"fmt"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/google/uuid"
+)
 
 //go:generate msgp
 //msgp:replace uuid.UUID with:[16]byte
 type (
+	// Message is encoded with msgpack (see message_type_gen.go) or JSON.
+	//
+	// In JSON, UUIDs are encoded as strings in their canonical form,
+	// Payload as standard base64 and timestamps as RFC 3339 strings.
 	Message struct {
-		ID      uuid.UUID           `msg:"i"`
-		From    Address             `msg:"f"`
-		To      Address             `msg:"t"`
-		Payload []byte              `msg:"p"`
-		ReplyTo uuid.UUID           `msg:"rt"`
-		Headers map[string][]string `msg:"h,omitempty"`
+		ID      uuid.UUID           `msg:"i" json:"id"`
+		From    Address             `msg:"f" json:"from"`
+		To      Address             `msg:"t" json:"to"`
+		Payload []byte              `msg:"p" json:"payload"`
+		ReplyTo uuid.UUID           `msg:"rt" json:"replyTo"`
+		Headers map[string][]string `msg:"h,omitempty" json:"headers,omitempty"`
+		// SentAt is provided by the sender, racks reject messages without it
+		SentAt time.Time `msg:"sa" json:"sentAt"`
+		// ArrivedAt is set by the rack when the message is first accepted
+		ArrivedAt time.Time `msg:"aa" json:"arrivedAt"`
 	}
 
 	Address struct {
-		Node    uuid.UUID `msg:"n"`
-		Process uint64    `msg:"p"`
+		Node    uuid.UUID `msg:"n" json:"node"`
+		Process uint64    `msg:"p" json:"process"`
+	}
+
+	// LogEntry is a message as recorded in the rack message log
+	LogEntry struct {
+		// Offset increases monotonically for each message accepted by a rack,
+		// durable racks keep increasing it after a restart (skipping some values)
+		// while other racks start again from 1
+		Offset  uint64   `msg:"o" json:"offset"`
+		Message *Message `msg:"m" json:"message"`
 	}
 )
+
+// routes returns true if a consumer taking from a can receive
+// a message addressed to to
+func (a Address) routes(to Address) bool {
+	if a.Node != to.Node {
+		return false
+	}
+	return a.Process == 0 || to.Process == 0 || a.Process == to.Process
+}
+
+// String returns the address as node/process
+func (a Address) String() string {
+	return fmt.Sprintf("%v/%v", a.Node, a.Process)
+}
+
+// ParseAddress parses the output of Address.String
+func ParseAddress(s string) (Address, error) {
+	node, process, found := strings.Cut(s, "/")
+	if !found {
+		return Address{}, fmt.Errorf("invalid address %q", s)
+	}
+	var a Address
+	var err error
+	a.Node, err = uuid.Parse(node)
+	if err != nil {
+		return Address{}, err
+	}
+	a.Process, err = strconv.ParseUint(process, 10, 64)
+	if err != nil {
+		return Address{}, err
+	}
+	return a, nil
+}
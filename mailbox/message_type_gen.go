@@ -134,6 +134,177 @@ func (z *Address) Msgsize() (s int) {
 	return
 }
 
+// DecodeMsg implements msgp.Decodable
+func (z *LogEntry) DecodeMsg(dc *msgp.Reader) (err error) {
+	var field []byte
+	_ = field
+	var zb0001 uint32
+	zb0001, err = dc.ReadMapHeader()
+	if err != nil {
+		err = msgp.WrapError(err)
+		return
+	}
+	for zb0001 > 0 {
+		zb0001--
+		field, err = dc.ReadMapKeyPtr()
+		if err != nil {
+			err = msgp.WrapError(err)
+			return
+		}
+		switch msgp.UnsafeString(field) {
+		case "o":
+			z.Offset, err = dc.ReadUint64()
+			if err != nil {
+				err = msgp.WrapError(err, "Offset")
+				return
+			}
+		case "m":
+			if dc.IsNil() {
+				err = dc.ReadNil()
+				if err != nil {
+					err = msgp.WrapError(err, "Message")
+					return
+				}
+				z.Message = nil
+			} else {
+				if z.Message == nil {
+					z.Message = new(Message)
+				}
+				err = z.Message.DecodeMsg(dc)
+				if err != nil {
+					err = msgp.WrapError(err, "Message")
+					return
+				}
+			}
+		default:
+			err = dc.Skip()
+			if err != nil {
+				err = msgp.WrapError(err)
+				return
+			}
+		}
+	}
+	return
+}
+
+// EncodeMsg implements msgp.Encodable
+func (z *LogEntry) EncodeMsg(en *msgp.Writer) (err error) {
+	// map header, size 2
+	// write "o"
+	err = en.Append(0x82, 0xa1, 0x6f)
+	if err != nil {
+		return
+	}
+	err = en.WriteUint64(z.Offset)
+	if err != nil {
+		err = msgp.WrapError(err, "Offset")
+		return
+	}
+	// write "m"
+	err = en.Append(0xa1, 0x6d)
+	if err != nil {
+		return
+	}
+	if z.Message == nil {
+		err = en.WriteNil()
+		if err != nil {
+			return
+		}
+	} else {
+		err = z.Message.EncodeMsg(en)
+		if err != nil {
+			err = msgp.WrapError(err, "Message")
+			return
+		}
+	}
+	return
+}
+
+// MarshalMsg implements msgp.Marshaler
+func (z *LogEntry) MarshalMsg(b []byte) (o []byte, err error) {
+	o = msgp.Require(b, z.Msgsize())
+	// map header, size 2
+	// string "o"
+	o = append(o, 0x82, 0xa1, 0x6f)
+	o = msgp.AppendUint64(o, z.Offset)
+	// string "m"
+	o = append(o, 0xa1, 0x6d)
+	if z.Message == nil {
+		o = msgp.AppendNil(o)
+	} else {
+		o, err = z.Message.MarshalMsg(o)
+		if err != nil {
+			err = msgp.WrapError(err, "Message")
+			return
+		}
+	}
+	return
+}
+
+// UnmarshalMsg implements msgp.Unmarshaler
+func (z *LogEntry) UnmarshalMsg(bts []byte) (o []byte, err error) {
+	var field []byte
+	_ = field
+	var zb0001 uint32
+	zb0001, bts, err = msgp.ReadMapHeaderBytes(bts)
+	if err != nil {
+		err = msgp.WrapError(err)
+		return
+	}
+	for zb0001 > 0 {
+		zb0001--
+		field, bts, err = msgp.ReadMapKeyZC(bts)
+		if err != nil {
+			err = msgp.WrapError(err)
+			return
+		}
+		switch msgp.UnsafeString(field) {
+		case "o":
+			z.Offset, bts, err = msgp.ReadUint64Bytes(bts)
+			if err != nil {
+				err = msgp.WrapError(err, "Offset")
+				return
+			}
+		case "m":
+			if msgp.IsNil(bts) {
+				bts, err = msgp.ReadNilBytes(bts)
+				if err != nil {
+					return
+				}
+				z.Message = nil
+			} else {
+				if z.Message == nil {
+					z.Message = new(Message)
+				}
+				bts, err = z.Message.UnmarshalMsg(bts)
+				if err != nil {
+					err = msgp.WrapError(err, "Message")
+					return
+				}
+			}
+		default:
+			bts, err = msgp.Skip(bts)
+			if err != nil {
+				err = msgp.WrapError(err)
+				return
+			}
+		}
+	}
+	o = bts
+	return
+}
+
+// Msgsize returns an upper bound estimate of the number of bytes occupied by the serialized message
+func (z *LogEntry) Msgsize() (s int) {
+	s = 1 + 2 + msgp.Uint64Size + 2
+	if z.Message == nil {
+		s += msgp.NilSize
+	} else {
+		s += z.Message.Msgsize()
+	}
+	return
+}
+
 // DecodeMsg implements msgp.Decodable
 func (z *Message) DecodeMsg(dc *msgp.Reader) (err error) {
 	var field []byte
@@ -283,6 +454,18 @@ func (z *Message) DecodeMsg(dc *msgp.Reader) (err error) {
 				}
 				z.Headers[za0005] = za0006
 			}
+		case "sa":
+			z.SentAt, err = dc.ReadTime()
+			if err != nil {
+				err = msgp.WrapError(err, "SentAt")
+				return
+			}
+		case "aa":
+			z.ArrivedAt, err = dc.ReadTime()
+			if err != nil {
+				err = msgp.WrapError(err, "ArrivedAt")
+				return
+			}
 		default:
 			err = dc.Skip()
 			if err != nil {
@@ -297,8 +480,8 @@ func (z *Message) DecodeMsg(dc *msgp.Reader) (err error) {
 // EncodeMsg implements msgp.Encodable
 func (z *Message) EncodeMsg(en *msgp.Writer) (err error) {
 	// check for omitted fields
-	zb0001Len := uint32(6)
-	var zb0001Mask uint8 /* 6 bits */
+	zb0001Len := uint32(8)
+	var zb0001Mask uint8 /* 8 bits */
 	_ = zb0001Mask
 	if z.Headers == nil {
 		zb0001Len--
@@ -425,6 +608,26 @@ func (z *Message) EncodeMsg(en *msgp.Writer) (err error) {
 				}
 			}
 		}
+		// write "sa"
+		err = en.Append(0xa2, 0x73, 0x61)
+		if err != nil {
+			return
+		}
+		err = en.WriteTime(z.SentAt)
+		if err != nil {
+			err = msgp.WrapError(err, "SentAt")
+			return
+		}
+		// write "aa"
+		err = en.Append(0xa2, 0x61, 0x61)
+		if err != nil {
+			return
+		}
+		err = en.WriteTime(z.ArrivedAt)
+		if err != nil {
+			err = msgp.WrapError(err, "ArrivedAt")
+			return
+		}
 	}
 	return
 }
@@ -433,8 +636,8 @@ func (z *Message) EncodeMsg(en *msgp.Writer) (err error) {
 func (z *Message) MarshalMsg(b []byte) (o []byte, err error) {
 	o = msgp.Require(b, z.Msgsize())
 	// check for omitted fields
-	zb0001Len := uint32(6)
-	var zb0001Mask uint8 /* 6 bits */
+	zb0001Len := uint32(8)
+	var zb0001Mask uint8 /* 8 bits */
 	_ = zb0001Mask
 	if z.Headers == nil {
 		zb0001Len--
@@ -484,6 +687,12 @@ func (z *Message) MarshalMsg(b []byte) (o []byte, err error) {
 				}
 			}
 		}
+		// string "sa"
+		o = append(o, 0xa2, 0x73, 0x61)
+		o = msgp.AppendTime(o, z.SentAt)
+		// string "aa"
+		o = append(o, 0xa2, 0x61, 0x61)
+		o = msgp.AppendTime(o, z.ArrivedAt)
 	}
 	return
 }
@@ -637,6 +846,18 @@ func (z *Message) UnmarshalMsg(bts []byte) (o []byte, err error) {
 				}
 				z.Headers[za0005] = za0006
 			}
+		case "sa":
+			z.SentAt, bts, err = msgp.ReadTimeBytes(bts)
+			if err != nil {
+				err = msgp.WrapError(err, "SentAt")
+				return
+			}
+		case "aa":
+			z.ArrivedAt, bts, err = msgp.ReadTimeBytes(bts)
+			if err != nil {
+				err = msgp.WrapError(err, "ArrivedAt")
+				return
+			}
 		default:
 			bts, err = msgp.Skip(bts)
 			if err != nil {
@@ -661,5 +882,6 @@ func (z *Message) Msgsize() (s int) {
 			}
 		}
 	}
+	s += 3 + msgp.TimeSize + 3 + msgp.TimeSize
 	return
 }
@@ -0,0 +1,113 @@
+package mailbox
+
+import (
+	"context"
+	"log/slog"
+	"sync/atomic"
+
+	"go.opentelemetry.io/otel"
+	"go.opentelemetry.io/otel/metric"
+	"go.opentelemetry.io/otel/metric/noop"
+)
+
+type (
+	rackMetrics struct {
+		delivered       metric.Int64Counter
+		parked          metric.Int64Counter
+		expired         metric.Int64Counter
+		evicted         metric.Int64Counter
+		followerDropped metric.Int64Counter
+		duplicates      metric.Int64Counter
+		rateLimited     metric.Int64Counter
+		deadLetters     metric.Int64Counter
+
+		parkedDepth      atomic.Int64
+		waitingConsumers atomic.Int64
+
+		registration metric.Registration
+	}
+)
+
+const meterName = "github.com/andrebq/mixtape/mailbox"
+
+// WithMeterProvider reports rack metrics to mp, by default the global
+// provider (otel.GetMeterProvider) is used
+func WithMeterProvider(mp metric.MeterProvider) Option {
+	return func(r *Rack) {
+		r.meterProvider = mp
+	}
+}
+
+func newRackMetrics(mp metric.MeterProvider) (*rackMetrics, error) {
+	if mp == nil {
+		mp = otel.GetMeterProvider()
+	}
+	meter := mp.Meter(meterName)
+	m := &rackMetrics{}
+	var err error
+	counter := func(name, desc string) metric.Int64Counter {
+		if err != nil {
+			return nil
+		}
+		var c metric.Int64Counter
+		c, err = meter.Int64Counter(name, metric.WithDescription(desc), metric.WithUnit("{message}"))
+		return c
+	}
+	m.delivered = counter("mailbox.rack.delivered", "Messages handed to consumers")
+	m.parked = counter("mailbox.rack.parked", "Messages parked because no consumer was waiting")
+	m.expired = counter("mailbox.rack.expired", "Parked messages removed after they expired")
+	m.evicted = counter("mailbox.rack.evicted", "Messages removed because the rack was full")
+	m.followerDropped = counter("mailbox.rack.follower_dropped", "Messages not sent to a message log follower because its buffer was full")
+	m.rateLimited = counter("mailbox.rack.rate_limited", "Messages rejected because the sender exceeded its limits")
+	m.duplicates = counter("mailbox.rack.duplicates", "Messages ignored because their ID was already accepted")
+	m.deadLetters = counter("mailbox.rack.dead_letters", "Expired or evicted messages sent to the dead-letter address")
+	if err != nil {
+		return nil, err
+	}
+	parkedDepth, err := meter.Int64ObservableGauge("mailbox.rack.parked_depth",
+		metric.WithDescription("Messages currently parked"), metric.WithUnit("{message}"))
+	if err != nil {
+		return nil, err
+	}
+	waiting, err := meter.Int64ObservableGauge("mailbox.rack.waiting_consumers",
+		metric.WithDescription("Consumers currently waiting for messages"), metric.WithUnit("{consumer}"))
+	if err != nil {
+		return nil, err
+	}
+	m.registration, err = meter.RegisterCallback(func(_ context.Context, o metric.Observer) error {
+		o.ObserveInt64(parkedDepth, m.parkedDepth.Load())
+		o.ObserveInt64(waiting, m.waitingConsumers.Load())
+		return nil
+	}, parkedDepth, waiting)
+	if err != nil {
+		return nil, err
+	}
+	return m, nil
+}
+
+// mustRackMetrics falls back to a noop provider if the instruments
+// cannot be created with mp
+func mustRackMetrics(mp metric.MeterProvider) *rackMetrics {
+	m, err := newRackMetrics(mp)
+	if err != nil {
+		slog.Error("Unable to create rack metrics, metrics are disabled", "error", err)
+		m, _ = newRackMetrics(noop.NewMeterProvider())
+	}
+	return m
+}
+
+// observe updates the values reported by the gauges
+func (m *rackMetrics) observe(parked, waiting int) {
+	m.parkedDepth.Store(int64(parked))
+	m.waitingConsumers.Store(int64(waiting))
+}
+
+func (m *rackMetrics) close() {
+	if err := m.registration.Unregister(); err != nil {
+		slog.Error("Unable to unregister rack metrics", "error", err)
+	}
+}
+
+func (m *rackMetrics) add(c metric.Int64Counter) {
+	c.Add(context.Background(), 1)
+}
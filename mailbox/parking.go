@@ -0,0 +1,144 @@
+package mailbox
+
+import (
+	"slices"
+	"time"
+
+	"github.com/google/uuid"
+)
+
+type (
+	// parking holds messages which arrived while no consumer was waiting
+	// for them, each inbox keeps its own FIFO queue
+	parking struct {
+		inboxes map[uuid.UUID][]entry
+		size    int
+		// dead counts the dead letters, which are not subject to the rack limits
+		dead int
+	}
+)
+
+func newParking() *parking {
+	return &parking{inboxes: map[uuid.UUID][]entry{}}
+}
+
+func (p *parking) len() int { return p.size }
+
+// live returns how many parked messages are not dead letters
+func (p *parking) live() int { return p.size - p.dead }
+
+// depth returns how many messages which are not dead letters are parked for inbox
+func (p *parking) depth(inbox uuid.UUID) int {
+	n := 0
+	for _, e := range p.inboxes[inbox] {
+		if !e.dead {
+			n++
+		}
+	}
+	return n
+}
+
+func (p *parking) push(e entry) {
+	inbox := e.msg.To.Node
+	p.inboxes[inbox] = append(p.inboxes[inbox], e)
+	p.count(e, 1)
+}
+
+// pushFront places e at the head of its inbox queue,
+// used for messages which must be delivered again
+func (p *parking) pushFront(e entry) {
+	inbox := e.msg.To.Node
+	p.inboxes[inbox] = append([]entry{e}, p.inboxes[inbox]...)
+	p.count(e, 1)
+}
+
+func (p *parking) count(e entry, delta int) {
+	p.size += delta
+	if e.dead {
+		p.dead += delta
+	}
+}
+
+// pop returns the oldest message parked for the node of addr which
+// can be routed to addr
+func (p *parking) pop(addr Address) (entry, bool) {
+	idx := slices.IndexFunc(p.inboxes[addr.Node], func(e entry) bool { return addr.routes(e.msg.To) })
+	if idx < 0 {
+		return entry{}, false
+	}
+	return p.remove(addr.Node, idx), true
+}
+
+// evict removes the oldest message parked for inbox which is not a dead letter
+func (p *parking) evict(inbox uuid.UUID) (entry, bool) {
+	idx := slices.IndexFunc(p.inboxes[inbox], func(e entry) bool { return !e.dead })
+	if idx < 0 {
+		return entry{}, false
+	}
+	return p.remove(inbox, idx), true
+}
+
+// evictDead removes the oldest dead letter parked for inbox
+func (p *parking) evictDead(inbox uuid.UUID) (entry, bool) {
+	idx := slices.IndexFunc(p.inboxes[inbox], func(e entry) bool { return e.dead })
+	if idx < 0 {
+		return entry{}, false
+	}
+	return p.remove(inbox, idx), true
+}
+
+// evictOldest removes the message which arrived first, across all inboxes,
+// dead letters are never evicted
+func (p *parking) evictOldest() (entry, bool) {
+	var oldest *entry
+	for _, queue := range p.inboxes {
+		idx := slices.IndexFunc(queue, func(e entry) bool { return !e.dead })
+		if idx >= 0 && (oldest == nil || queue[idx].offset < oldest.offset) {
+			oldest = &queue[idx]
+		}
+	}
+	if oldest == nil {
+		return entry{}, false
+	}
+	return p.evict(oldest.msg.To.Node)
+}
+
+func (p *parking) remove(inbox uuid.UUID, idx int) entry {
+	queue := p.inboxes[inbox]
+	e := queue[idx]
+	queue = slices.Delete(queue, idx, idx+1)
+	if len(queue) == 0 {
+		delete(p.inboxes, inbox)
+	} else {
+		p.inboxes[inbox] = queue
+	}
+	p.count(e, -1)
+	return e
+}
+
+// expire removes every message whose expiration is before now,
+// calling fn for each one of them after they were removed, so fn
+// can park other messages
+func (p *parking) expire(now time.Time, fn func(entry)) {
+	var expired []entry
+	for inbox, queue := range p.inboxes {
+		kept := queue[:0]
+		for _, e := range queue {
+			if e.expire.Before(now) {
+				p.count(e, -1)
+				expired = append(expired, e)
+				continue
+			}
+			kept = append(kept, e)
+		}
+		clear(queue[len(kept):])
+		if len(kept) == 0 {
+			delete(p.inboxes, inbox)
+		} else {
+			p.inboxes[inbox] = kept
+		}
+	}
+	for _, e := range expired {
+		fn(e)
+	}
+}
@@ -0,0 +1,133 @@
+package mailbox
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"sync"
+	"time"
+)
+
+type (
+	// RateLimit allows Burst messages at once, refilled at Rate messages per second
+	// (which must be greater than 0), see Quota for limits over longer periods
+	RateLimit struct {
+		Rate  float64
+		Burst int
+	}
+
+	// RateLimitError is returned by Deliver when the sender exceeded one of its limits,
+	// it matches ErrRateLimited with errors.Is
+	RateLimitError struct {
+		Sender string
+		// RetryAfter is how long the sender should wait before trying again
+		RetryAfter time.Duration
+	}
+
+	// senderLimits keeps one set of token buckets per sender
+	senderLimits struct {
+		l         sync.Mutex
+		limits    []RateLimit
+		senders   map[string][]bucket
+		lastSweep time.Time
+	}
+
+	bucket struct {
+		tokens float64
+		last   time.Time
+	}
+
+	senderKey struct{}
+)
+
+var ErrRateLimited = errors.New("rate limited")
+
+// Quota returns a limit of n messages per period
+func Quota(n int, per time.Duration) RateLimit {
+	return RateLimit{Rate: float64(n) / per.Seconds(), Burst: n}
+}
+
+// WithSenderLimits limits how many messages each sender can deliver, a message
+// is only accepted if it fits in every limit. Senders are identified by From.Node,
+// unless ctx carries another identity (see WithSender).
+func WithSenderLimits(limits ...RateLimit) Option {
+	return func(r *Rack) {
+		if len(limits) == 0 {
+			r.limits = nil
+			return
+		}
+		r.limits = &senderLimits{limits: limits, senders: map[string][]bucket{}}
+	}
+}
+
+// WithSender returns a copy of ctx which identifies the sender by key
+// when applying rate limits, used by servers which authenticate senders
+func WithSender(ctx context.Context, key string) context.Context {
+	return context.WithValue(ctx, senderKey{}, key)
+}
+
+func (e *RateLimitError) Error() string {
+	return fmt.Sprintf("%v: sender %v should retry after %v", ErrRateLimited, e.Sender, e.RetryAfter)
+}
+
+func (e *RateLimitError) Unwrap() error { return ErrRateLimited }
+
+// sender returns the key used to rate limit msg
+func sender(ctx context.Context, msg *Message) string {
+	if key, ok := ctx.Value(senderKey{}).(string); ok {
+		return key
+	}
+	return msg.From.Node.String()
+}
+
+// allow takes one token from every bucket of sender, if any of them
+// is empty no token is taken and a *RateLimitError is returned
+func (s *senderLimits) allow(sender string, now time.Time) error {
+	s.l.Lock()
+	defer s.l.Unlock()
+	s.sweep(now)
+	buckets, found := s.senders[sender]
+	if !found {
+		buckets = make([]bucket, len(s.limits))
+		for i, l := range s.limits {
+			buckets[i] = bucket{tokens: float64(l.Burst), last: now}
+		}
+		s.senders[sender] = buckets
+	}
+	var retry time.Duration
+	for i, l := range s.limits {
+		b := &buckets[i]
+		b.tokens = min(float64(l.Burst), b.tokens+now.Sub(b.last).Seconds()*l.Rate)
+		b.last = now
+		if b.tokens < 1 {
+			retry = max(retry, time.Duration((1-b.tokens)/l.Rate*float64(time.Second)))
+		}
+	}
+	if retry > 0 {
+		return &RateLimitError{Sender: sender, RetryAfter: retry}
+	}
+	for i := range buckets {
+		buckets[i].tokens--
+	}
+	return nil
+}
+
+// sweep removes senders whose buckets are full again, at most once a minute
+func (s *senderLimits) sweep(now time.Time) {
+	if now.Sub(s.lastSweep) < time.Minute {
+		return
+	}
+	s.lastSweep = now
+	for sender, buckets := range s.senders {
+		full := true
+		for i, l := range s.limits {
+			if buckets[i].tokens+now.Sub(buckets[i].last).Seconds()*l.Rate < float64(l.Burst) {
+				full = false
+				break
+			}
+		}
+		if full {
+			delete(s.senders, sender)
+		}
+	}
+}
@@ -0,0 +1,69 @@
+package mailbox
+
+import (
+	"context"
+	"maps"
+
+	"github.com/andrebq/mixtape/generics"
+	"github.com/google/uuid"
+)
+
+type (
+	// Remote is a rack which lives in another process
+	Remote interface {
+		Deliver(ctx context.Context, msg *Message) error
+	}
+
+	// Registry maps nodes to the rack they consume from (their home rack),
+	// nodes which are not registered are considered local.
+	Registry struct {
+		nodes generics.SyncMap[uuid.UUID, Remote]
+	}
+)
+
+// ForwardedHeader is added to messages forwarded by a rack to the home rack
+// of their recipient. Messages carrying it are always delivered locally,
+// so a misconfigured registry can only cause one extra hop.
+const ForwardedHeader = "Mailbox-Forwarded"
+
+// WithRegistry enables forwarding of messages addressed to nodes
+// which have another home rack
+func WithRegistry(reg *Registry) Option {
+	return func(r *Rack) {
+		r.registry = reg
+	}
+}
+
+func (r *Registry) Register(node uuid.UUID, home Remote) {
+	r.nodes.Put(node, home)
+}
+
+func (r *Registry) Unregister(node uuid.UUID) {
+	r.nodes.Delete(node)
+}
+
+func (r *Registry) Lookup(node uuid.UUID) (Remote, bool) {
+	if r == nil {
+		return nil, false
+	}
+	return r.nodes.Get(node)
+}
+
+// forward delivers msg to its home rack, returns false if msg
+// should be delivered locally
+func (r *Rack) forward(ctx context.Context, msg *Message) (bool, error) {
+	if _, forwarded := msg.Headers[ForwardedHeader]; forwarded {
+		return false, nil
+	}
+	home, found := r.registry.Lookup(msg.To.Node)
+	if !found {
+		return false, nil
+	}
+	fwd := *msg
+	fwd.Headers = maps.Clone(msg.Headers)
+	if fwd.Headers == nil {
+		fwd.Headers = map[string][]string{}
+	}
+	fwd.Headers[ForwardedHeader] = []string{"true"}
+	return true, home.Deliver(ctx, &fwd)
+}
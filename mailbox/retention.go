@@ -0,0 +1,136 @@
+package mailbox
+
+import (
+	"errors"
+	"fmt"
+	"time"
+)
+
+type (
+	// OverflowPolicy decides what happens to a message which arrives
+	// when the rack (or the inbox) cannot park more messages
+	OverflowPolicy uint8
+)
+
+const (
+	// DropNew silently drops the message which just arrived
+	DropNew OverflowPolicy = iota
+	// EvictOldest removes the oldest parked message to make room for the new one
+	EvictOldest
+	// RejectNew makes Deliver return ErrRackFull
+	RejectNew
+)
+
+// TTLHeader shortens how long a message stays parked, the value
+// must be a valid time.Duration (eg.: 30s, 5m). Values above the
+// rack TTL (see WithRetention) are clamped to it
+const TTLHeader = "Mailbox-TTL"
+
+var (
+	ErrRackFull   = errors.New("rack full")
+	ErrInvalidTTL = errors.New("invalid ttl header")
+)
+
+// WithRetention sets how many messages the rack keeps parked and
+// for how long, defaults to 1000 messages for 1 minute
+func WithRetention(maxParked int, ttl time.Duration) Option {
+	return func(r *Rack) {
+		r.maxParked = maxParked
+		r.ttl = ttl
+	}
+}
+
+// WithInboxDepth limits how many messages can be parked for a single inbox,
+// 0 (the default) means only the rack limit applies
+func WithInboxDepth(n int) Option {
+	return func(r *Rack) {
+		r.inboxDepth = n
+	}
+}
+
+// WithOverflow sets the policy used when the rack or an inbox is full,
+// defaults to DropNew
+func WithOverflow(p OverflowPolicy) Option {
+	return func(r *Rack) {
+		r.overflow = p
+	}
+}
+
+// expiration returns when msg should be removed from the rack if it
+// is still parked, taking TTLHeader and DeliverAfterHeader into account
+func (r *Rack) expiration(msg *Message) (time.Time, error) {
+	ttl := r.ttl
+	if v := msg.Headers[TTLHeader]; len(v) > 0 {
+		var err error
+		ttl, err = time.ParseDuration(v[0])
+		if err != nil || ttl <= 0 {
+			return time.Time{}, fmt.Errorf("%w: %q", ErrInvalidTTL, v[0])
+		}
+		ttl = min(ttl, r.ttl)
+	}
+	due, err := dueAt(msg)
+	if err != nil {
+		return time.Time{}, err
+	}
+	if time.Until(due) > r.horizon {
+		return time.Time{}, fmt.Errorf("%w: %v is more than %v ahead", ErrInvalidDeliverAfter, due.Format(time.RFC3339Nano), r.horizon)
+	}
+	if due.After(msg.ArrivedAt) {
+		return due.Add(ttl), nil
+	}
+	return msg.ArrivedAt.Add(ttl), nil
+}
+
+// park keeps e until a consumer takes it, applying the overflow
+// policy if there is no space left. Returns false if e was not kept
+func (l *rackLoop) park(e entry) (bool, error) {
+	if ok, err := l.admit(e); !ok {
+		return false, err
+	}
+	l.parked.push(e)
+	l.metrics.add(l.metrics.parked)
+	l.tracePark(e.msg)
+	return true, nil
+}
+
+// admit applies the overflow policy if the rack (or the inbox of e) is full,
+// returns false if e must not be kept. Parked and scheduled messages count
+// towards the limits, dead letters do not.
+func (l *rackLoop) admit(e entry) (bool, error) {
+	l.expire(time.Now())
+	inbox := e.msg.To.Node
+	inboxFull := l.inboxDepth > 0 && l.parked.depth(inbox)+l.scheduledFor(inbox) >= l.inboxDepth
+	if !inboxFull && l.parked.live()+len(l.scheduled) < l.maxParked {
+		return true, nil
+	}
+	switch l.overflow {
+	case EvictOldest:
+		var victim entry
+		var found bool
+		if inboxFull {
+			victim, found = l.parked.evict(inbox)
+		} else {
+			victim, found = l.parked.evictOldest()
+		}
+		if found {
+			l.evict(victim)
+			return true, nil
+		}
+		// only scheduled messages are held, which are never evicted
+		l.evict(e)
+		return false, nil
+	case RejectNew:
+		l.forget(e)
+		return false, ErrRackFull
+	default:
+		l.evict(e)
+		return false, nil
+	}
+}
+
+// evict removes e from the rack, sending it to the dead-letter address
+func (l *rackLoop) evict(e entry) {
+	l.metrics.add(l.metrics.evicted)
+	l.forget(e)
+	l.deadLetter(e, ReasonEvicted)
+}
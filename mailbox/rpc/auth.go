@@ -0,0 +1,117 @@
+package rpc
+
+import (
+	"context"
+	"strings"
+	"time"
+
+	"github.com/andrebq/mixtape/api"
+	mailboxapi "github.com/andrebq/mixtape/mailbox/api"
+	"github.com/google/uuid"
+	"google.golang.org/grpc"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/metadata"
+	"google.golang.org/grpc/status"
+)
+
+type (
+	capabilityKey struct{}
+
+	// authStream replaces the context of a stream with one carrying the capability
+	authStream struct {
+		grpc.ServerStream
+		ctx context.Context
+	}
+)
+
+var servicePrefix = "/" + api.Mailbox_ServiceDesc.ServiceName + "/"
+
+// WithTokenKey requires every call to carry a capability token signed with key
+// (see mailbox/api.SignToken), the grpc.Server must use the interceptors from
+// Server.ServerOptions to verify them
+func WithTokenKey(key []byte) Option {
+	return func(s *Server) {
+		s.tokenKey = key
+	}
+}
+
+// WithToken returns a context which makes the client send token with every call
+func WithToken(ctx context.Context, token string) context.Context {
+	return metadata.AppendToOutgoingContext(ctx, "authorization", "Bearer "+token)
+}
+
+// ServerOptions returns the interceptors which verify the tokens of calls to the
+// Mailbox service, calls to other services of the same grpc.Server are not affected
+func (s *Server) ServerOptions() []grpc.ServerOption {
+	return []grpc.ServerOption{
+		grpc.ChainUnaryInterceptor(s.unaryInterceptor),
+		grpc.ChainStreamInterceptor(s.streamInterceptor),
+	}
+}
+
+func (s *Server) unaryInterceptor(ctx context.Context, req any, info *grpc.UnaryServerInfo, handler grpc.UnaryHandler) (any, error) {
+	if !strings.HasPrefix(info.FullMethod, servicePrefix) {
+		return handler(ctx, req)
+	}
+	ctx, err := s.verify(ctx)
+	if err != nil {
+		return nil, err
+	}
+	return handler(ctx, req)
+}
+
+func (s *Server) streamInterceptor(srv any, stream grpc.ServerStream, info *grpc.StreamServerInfo, handler grpc.StreamHandler) error {
+	if !strings.HasPrefix(info.FullMethod, servicePrefix) {
+		return handler(srv, stream)
+	}
+	ctx, err := s.verify(stream.Context())
+	if err != nil {
+		return err
+	}
+	return handler(srv, authStream{ServerStream: stream, ctx: ctx})
+}
+
+func (a authStream) Context() context.Context { return a.ctx }
+
+// verify checks the bearer token in the metadata of the call and returns
+// a context carrying its capability
+func (s *Server) verify(ctx context.Context) (context.Context, error) {
+	if len(s.tokenKey) == 0 {
+		return ctx, nil
+	}
+	md, _ := metadata.FromIncomingContext(ctx)
+	var authorization string
+	if v := md.Get("authorization"); len(v) > 0 {
+		authorization = v[0]
+	}
+	capability, err := mailboxapi.Authenticate(s.tokenKey, authorization, time.Now())
+	if err != nil {
+		return nil, statusError(err)
+	}
+	return context.WithValue(ctx, capabilityKey{}, capability), nil
+}
+
+// capability returns the capability verified by the interceptors, which is nil
+// when no token key is configured. Calls which were not intercepted are rejected.
+func (s *Server) capability(ctx context.Context) (*mailboxapi.Capability, error) {
+	if len(s.tokenKey) == 0 {
+		return nil, nil
+	}
+	c, ok := ctx.Value(capabilityKey{}).(*mailboxapi.Capability)
+	if !ok {
+		return nil, status.Error(codes.Unauthenticated, "token was not verified")
+	}
+	return c, nil
+}
+
+// authorize checks if the call carries a token which grants perm on inbox
+func (s *Server) authorize(ctx context.Context, inbox uuid.UUID, perm mailboxapi.Perm) (*mailboxapi.Capability, error) {
+	c, err := s.capability(ctx)
+	if err != nil {
+		return nil, err
+	}
+	if err := mailboxapi.Authorize(c, inbox, perm); err != nil {
+		return nil, statusError(err)
+	}
+	return c, nil
+}
@@ -0,0 +1,117 @@
+package rpc
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"iter"
+
+	"github.com/andrebq/mixtape/api"
+	"github.com/andrebq/mixtape/mailbox"
+	"google.golang.org/genproto/googleapis/rpc/errdetails"
+	"google.golang.org/grpc"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/status"
+)
+
+type (
+	// Client talks to a rack exposed by Server
+	Client struct {
+		mailbox api.MailboxClient
+	}
+)
+
+var (
+	_ mailbox.Transport = (*Client)(nil)
+	_ mailbox.Remote    = (*Client)(nil)
+)
+
+// NewClient returns a client which uses cc, the connection can be shared
+// with other services (eg.: TaskManager)
+func NewClient(cc grpc.ClientConnInterface) *Client {
+	return &Client{mailbox: api.NewMailboxClient(cc)}
+}
+
+// Deliver sends msg to the rack, the trace context of ctx is sent along
+// with the headers of msg, which are not modified (see mailbox.InjectTraceContext)
+func (c *Client) Deliver(ctx context.Context, msg *mailbox.Message) error {
+	sent := *msg
+	mailbox.InjectTraceContext(ctx, &sent)
+	_, err := c.mailbox.Deliver(ctx, toMessage(&sent))
+	if status.Code(err) != codes.ResourceExhausted {
+		return err
+	}
+	// rate limited senders get a RetryInfo detail, a full rack does not
+	for _, d := range status.Convert(err).Details() {
+		if retry, ok := d.(*errdetails.RetryInfo); ok {
+			return &mailbox.RateLimitError{Sender: msg.From.Node.String(), RetryAfter: retry.RetryDelay.AsDuration()}
+		}
+	}
+	return fmt.Errorf("%w: %v", mailbox.ErrRackFull, err)
+}
+
+// TakeAddress waits until a message for addr arrives, the message is acknowledged
+// as soon as it is received
+func (c *Client) TakeAddress(ctx context.Context, addr mailbox.Address) (*mailbox.Message, error) {
+	ctx, cancel := context.WithCancel(ctx)
+	defer cancel()
+	stream, err := c.mailbox.Take(ctx)
+	if err != nil {
+		return nil, err
+	}
+	if err := stream.Send(&api.TakeRequest{Request: &api.TakeRequest_Take{Take: toAddress(addr)}}); err != nil {
+		return nil, err
+	}
+	res, err := stream.Recv()
+	if err != nil {
+		return nil, err
+	}
+	delivery := res.GetDelivery()
+	if delivery == nil {
+		return nil, errors.New("unexpected take response")
+	}
+	msg, err := fromMessage(delivery.Message)
+	if err != nil {
+		return nil, err
+	}
+	if err := stream.Send(&api.TakeRequest{Request: &api.TakeRequest_Ack{Ack: delivery.Lease}}); err != nil {
+		return nil, err
+	}
+	res, err = stream.Recv()
+	if err != nil {
+		return nil, err
+	}
+	if !res.GetAck().GetFound() {
+		return nil, mailbox.ErrLeaseNotFound
+	}
+	stream.CloseSend()
+	return msg, nil
+}
+
+// Subscribe streams messages for addr, iteration stops when the consumer breaks out
+// of the loop or the stream fails, in which case the last value contains the error
+func (c *Client) Subscribe(ctx context.Context, addr mailbox.Address) iter.Seq2[*mailbox.Message, error] {
+	return func(yield func(*mailbox.Message, error) bool) {
+		ctx, cancel := context.WithCancel(ctx)
+		defer cancel()
+		stream, err := c.mailbox.Subscribe(ctx, &api.SubscribeRequest{Address: toAddress(addr)})
+		if err != nil {
+			yield(nil, err)
+			return
+		}
+		for {
+			m, err := stream.Recv()
+			if errors.Is(err, io.EOF) {
+				return
+			} else if err != nil {
+				yield(nil, err)
+				return
+			}
+			msg, err := fromMessage(m)
+			if !yield(msg, err) || err != nil {
+				return
+			}
+		}
+	}
+}
@@ -0,0 +1,90 @@
+package rpc
+
+import (
+	"fmt"
+
+	"github.com/andrebq/mixtape/api"
+	"github.com/andrebq/mixtape/mailbox"
+	"github.com/google/uuid"
+	"google.golang.org/protobuf/types/known/timestamppb"
+)
+
+func toAddress(a mailbox.Address) *api.MailboxAddress {
+	return &api.MailboxAddress{Node: a.Node[:], Process: a.Process}
+}
+
+func fromAddress(a *api.MailboxAddress) (mailbox.Address, error) {
+	if a == nil {
+		return mailbox.Address{}, nil
+	}
+	node, err := fromUUID(a.Node)
+	if err != nil {
+		return mailbox.Address{}, err
+	}
+	return mailbox.Address{Node: node, Process: a.Process}, nil
+}
+
+func fromUUID(buf []byte) (uuid.UUID, error) {
+	if len(buf) == 0 {
+		return uuid.Nil, nil
+	}
+	id, err := uuid.FromBytes(buf)
+	if err != nil {
+		return uuid.Nil, fmt.Errorf("invalid uuid: %w", err)
+	}
+	return id, nil
+}
+
+func toMessage(msg *mailbox.Message) *api.MailboxMessage {
+	out := &api.MailboxMessage{
+		Id:      msg.ID[:],
+		From:    toAddress(msg.From),
+		To:      toAddress(msg.To),
+		Payload: msg.Payload,
+		ReplyTo: msg.ReplyTo[:],
+	}
+	if len(msg.Headers) > 0 {
+		out.Headers = make(map[string]*api.HeaderValues, len(msg.Headers))
+		for k, v := range msg.Headers {
+			out.Headers[k] = &api.HeaderValues{Values: v}
+		}
+	}
+	if !msg.SentAt.IsZero() {
+		out.SentAt = timestamppb.New(msg.SentAt)
+	}
+	if !msg.ArrivedAt.IsZero() {
+		out.ArrivedAt = timestamppb.New(msg.ArrivedAt)
+	}
+	return out
+}
+
+func fromMessage(m *api.MailboxMessage) (*mailbox.Message, error) {
+	var msg mailbox.Message
+	var err error
+	if msg.ID, err = fromUUID(m.Id); err != nil {
+		return nil, err
+	}
+	if msg.ReplyTo, err = fromUUID(m.ReplyTo); err != nil {
+		return nil, err
+	}
+	if msg.From, err = fromAddress(m.From); err != nil {
+		return nil, err
+	}
+	if msg.To, err = fromAddress(m.To); err != nil {
+		return nil, err
+	}
+	msg.Payload = m.Payload
+	if len(m.Headers) > 0 {
+		msg.Headers = make(map[string][]string, len(m.Headers))
+		for k, v := range m.Headers {
+			msg.Headers[k] = v.GetValues()
+		}
+	}
+	if m.SentAt != nil {
+		msg.SentAt = m.SentAt.AsTime()
+	}
+	if m.ArrivedAt != nil {
+		msg.ArrivedAt = m.ArrivedAt.AsTime()
+	}
+	return &msg, nil
+}
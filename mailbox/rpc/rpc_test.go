@@ -0,0 +1,253 @@
+package rpc_test
+
+import (
+	"context"
+	"errors"
+	"io"
+	"net"
+	"reflect"
+	"testing"
+	"time"
+
+	"github.com/andrebq/mixtape/api"
+	"github.com/andrebq/mixtape/mailbox"
+	mailboxapi "github.com/andrebq/mixtape/mailbox/api"
+	"github.com/andrebq/mixtape/mailbox/rpc"
+	"github.com/google/uuid"
+	"google.golang.org/grpc"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/credentials/insecure"
+	"google.golang.org/grpc/status"
+	"google.golang.org/grpc/test/bufconn"
+)
+
+func serve(t *testing.T, rack *mailbox.Rack, opts ...rpc.Option) *grpc.ClientConn {
+	lis := bufconn.Listen(1 << 20)
+	mb := rpc.NewServer(rack, opts...)
+	srv := grpc.NewServer(mb.ServerOptions()...)
+	mb.Register(srv)
+	go srv.Serve(lis)
+	t.Cleanup(srv.Stop)
+	conn, err := grpc.NewClient("passthrough:///bufconn",
+		grpc.WithContextDialer(func(ctx context.Context, _ string) (net.Conn, error) { return lis.DialContext(ctx) }),
+		grpc.WithTransportCredentials(insecure.NewCredentials()))
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { conn.Close() })
+	return conn
+}
+
+func TestClient(t *testing.T) {
+	rack := mailbox.NewRack()
+	defer rack.Close()
+	client := rpc.NewClient(serve(t, rack))
+	ctx, cancel := context.WithTimeout(context.Background(), time.Second)
+	defer cancel()
+
+	to := mailbox.Address{Node: uuid.Must(uuid.NewRandom()), Process: 1}
+	var sent []*mailbox.Message
+	for range 3 {
+		msg := &mailbox.Message{
+			ID:      uuid.Must(uuid.NewRandom()),
+			From:    mailbox.Address{Node: uuid.Must(uuid.NewRandom())},
+			To:      to,
+			Payload: []byte("hello"),
+			Headers: map[string][]string{"Kind": {"greeting"}},
+			SentAt:  time.Now().Round(0).UTC(),
+		}
+		if err := client.Deliver(ctx, msg); err != nil {
+			t.Fatal(err)
+		}
+		sent = append(sent, msg)
+	}
+	msg, err := client.TakeAddress(ctx, to)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if msg.ArrivedAt.IsZero() {
+		t.Fatal("ArrivedAt should be set by the rack")
+	}
+	msg.ArrivedAt = time.Time{}
+	if !reflect.DeepEqual(msg, sent[0]) {
+		t.Fatalf("Expecting %#v got %#v", sent[0], msg)
+	}
+
+	var received []uuid.UUID
+	for msg, err := range client.Subscribe(ctx, to) {
+		if err != nil {
+			t.Fatal(err)
+		}
+		received = append(received, msg.ID)
+		if len(received) == 2 {
+			break
+		}
+	}
+	if !reflect.DeepEqual(received, []uuid.UUID{sent[1].ID, sent[2].ID}) {
+		t.Fatalf("Unexpected messages %v", received)
+	}
+
+	err = client.Deliver(ctx, &mailbox.Message{ID: uuid.Must(uuid.NewRandom()), To: to})
+	if status.Code(err) != codes.InvalidArgument {
+		t.Fatalf("Message without SentAt should be rejected, got %v", err)
+	}
+}
+
+func TestTakeStream(t *testing.T) {
+	rack := mailbox.NewRack(mailbox.WithLeaseTimeout(time.Second / 50))
+	defer rack.Close()
+	mb := api.NewMailboxClient(serve(t, rack))
+	ctx, cancel := context.WithTimeout(context.Background(), time.Second)
+	defer cancel()
+
+	to := mailbox.Address{Node: uuid.Must(uuid.NewRandom())}
+	msg := &mailbox.Message{ID: uuid.Must(uuid.NewRandom()), To: to, SentAt: time.Now()}
+	if err := rack.Deliver(ctx, msg); err != nil {
+		t.Fatal(err)
+	}
+	stream, err := mb.Take(ctx)
+	if err != nil {
+		t.Fatal(err)
+	}
+	take := &api.TakeRequest{Request: &api.TakeRequest_Take{Take: &api.MailboxAddress{Node: to.Node[:]}}}
+	var lease []byte
+	// the first lease is not acknowledged, so the message is delivered again
+	for range 2 {
+		if err := stream.Send(take); err != nil {
+			t.Fatal(err)
+		}
+		res, err := stream.Recv()
+		if err != nil {
+			t.Fatal(err)
+		}
+		if !reflect.DeepEqual(res.GetDelivery().GetMessage().GetId(), msg.ID[:]) {
+			t.Fatalf("Unexpected delivery %v", res)
+		}
+		lease = res.GetDelivery().GetLease()
+	}
+	// leases are only acknowledged on the stream which handed them out
+	other, err := mb.Take(ctx)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := other.Send(&api.TakeRequest{Request: &api.TakeRequest_Ack{Ack: lease}}); err != nil {
+		t.Fatal(err)
+	}
+	if res, err := other.Recv(); err != nil {
+		t.Fatal(err)
+	} else if res.GetAck().GetFound() {
+		t.Fatalf("Lease should not be found by another stream, got %v", res)
+	}
+	for _, found := range []bool{true, false} {
+		if err := stream.Send(&api.TakeRequest{Request: &api.TakeRequest_Ack{Ack: lease}}); err != nil {
+			t.Fatal(err)
+		}
+		res, err := stream.Recv()
+		if err != nil {
+			t.Fatal(err)
+		}
+		if res.GetAck().GetFound() != found {
+			t.Fatalf("Expecting found=%v got %v", found, res)
+		}
+	}
+	stream.CloseSend()
+	if _, err := stream.Recv(); !errors.Is(err, io.EOF) {
+		t.Fatalf("Stream should end after CloseSend, got %v", err)
+	}
+}
+
+func TestRateLimit(t *testing.T) {
+	rack := mailbox.NewRack(mailbox.WithSenderLimits(mailbox.Quota(1, time.Minute)))
+	defer rack.Close()
+	client := rpc.NewClient(serve(t, rack))
+	ctx, cancel := context.WithTimeout(context.Background(), time.Second)
+	defer cancel()
+
+	from := mailbox.Address{Node: uuid.Must(uuid.NewRandom())}
+	deliver := func() error {
+		return client.Deliver(ctx, &mailbox.Message{ID: uuid.Must(uuid.NewRandom()), From: from, To: from, SentAt: time.Now()})
+	}
+	if err := deliver(); err != nil {
+		t.Fatal(err)
+	}
+	var limited *mailbox.RateLimitError
+	if err := deliver(); !errors.As(err, &limited) || limited.RetryAfter <= 0 {
+		t.Fatalf("Expecting RateLimitError got %v", err)
+	}
+}
+
+func TestTokens(t *testing.T) {
+	key := []byte("not so secret")
+	rack := mailbox.NewRack(mailbox.WithSenderLimits(mailbox.Quota(2, time.Minute)))
+	defer rack.Close()
+	client := rpc.NewClient(serve(t, rack, rpc.WithTokenKey(key)))
+	ctx, cancel := context.WithTimeout(context.Background(), time.Second)
+	defer cancel()
+
+	inbox := mailbox.Address{Node: uuid.Must(uuid.NewRandom())}
+	token := func(perm mailboxapi.Perm) context.Context {
+		tk, err := mailboxapi.SignToken(key, mailboxapi.Capability{Subject: "runner", Inboxes: []uuid.UUID{inbox.Node}, Perm: perm, Expires: time.Now().Add(time.Minute)})
+		if err != nil {
+			t.Fatal(err)
+		}
+		return rpc.WithToken(ctx, tk)
+	}
+	writer, reader := token(mailboxapi.PermWrite), token(mailboxapi.PermRead)
+	newMsg := func(to mailbox.Address) *mailbox.Message {
+		// every message comes from a different node, limits apply to the token subject
+		return &mailbox.Message{ID: uuid.Must(uuid.NewRandom()), From: mailbox.Address{Node: uuid.Must(uuid.NewRandom())}, To: to, SentAt: time.Now()}
+	}
+
+	if err := client.Deliver(ctx, newMsg(inbox)); status.Code(err) != codes.Unauthenticated {
+		t.Fatalf("Deliver without token should fail, got %v", err)
+	}
+	if err := client.Deliver(reader, newMsg(inbox)); status.Code(err) != codes.PermissionDenied {
+		t.Fatalf("Deliver with a read only token should fail, got %v", err)
+	}
+	if err := client.Deliver(writer, newMsg(mailbox.Address{})); status.Code(err) != codes.PermissionDenied {
+		t.Fatalf("Deliver to the nil inbox should fail, got %v", err)
+	}
+	msg := newMsg(inbox)
+	if err := client.Deliver(writer, msg); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := client.TakeAddress(writer, inbox); status.Code(err) != codes.PermissionDenied {
+		t.Fatalf("Take with a write only token should fail, got %v", err)
+	}
+	if actual, err := client.TakeAddress(reader, inbox); err != nil {
+		t.Fatal(err)
+	} else if actual.ID != msg.ID {
+		t.Fatalf("Unexpected message %v", actual.ID)
+	}
+
+	if err := client.Deliver(writer, newMsg(inbox)); err != nil {
+		t.Fatal(err)
+	}
+	var limited *mailbox.RateLimitError
+	if err := client.Deliver(writer, newMsg(inbox)); !errors.As(err, &limited) {
+		t.Fatalf("Expecting RateLimitError got %v", err)
+	}
+}
+
+func TestPendingTakes(t *testing.T) {
+	rack := mailbox.NewRack()
+	defer rack.Close()
+	mb := api.NewMailboxClient(serve(t, rack))
+	ctx, cancel := context.WithTimeout(context.Background(), time.Second)
+	defer cancel()
+
+	stream, err := mb.Take(ctx)
+	if err != nil {
+		t.Fatal(err)
+	}
+	node := uuid.Must(uuid.NewRandom())
+	take := &api.TakeRequest{Request: &api.TakeRequest_Take{Take: &api.MailboxAddress{Node: node[:]}}}
+	for range rpc.MaxPendingTakes + 1 {
+		if err := stream.Send(take); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if _, err := stream.Recv(); status.Code(err) != codes.ResourceExhausted {
+		t.Fatalf("Expecting ResourceExhausted got %v", err)
+	}
+}
@@ -0,0 +1,254 @@
+// Package rpc exposes a mailbox.Rack with the Mailbox gRPC service (see api/mailbox.proto)
+// and implements a mailbox.Transport on top of it.
+package rpc
+
+import (
+	"context"
+	"errors"
+	"io"
+	"log/slog"
+
+	"github.com/andrebq/mixtape/api"
+	"github.com/andrebq/mixtape/mailbox"
+	mailboxapi "github.com/andrebq/mixtape/mailbox/api"
+	"github.com/google/uuid"
+	"google.golang.org/genproto/googleapis/rpc/errdetails"
+	"google.golang.org/grpc"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/status"
+	"google.golang.org/protobuf/types/known/durationpb"
+)
+
+type (
+	// Server implements api.MailboxServer backed by a rack.
+	//
+	// Take streams hand out leased messages (see mailbox.Rack.TakeLease), clients must
+	// acknowledge each delivery on the same stream otherwise it is delivered again after
+	// the lease timeout.
+	// Subscribe acknowledges messages once they are sent.
+	//
+	// When a token key is configured (see WithTokenKey), calls are authorized like
+	// the HTTP API (see mailbox/api.Capability) and senders are identified by the
+	// token subject.
+	Server struct {
+		api.UnimplementedMailboxServer
+		rack     *mailbox.Rack
+		tokenKey []byte
+	}
+
+	// Option configures a Server
+	Option func(*Server)
+)
+
+// MaxPendingTakes is how many takes a single Take stream can have
+// waiting for messages at the same time
+const MaxPendingTakes = mailboxapi.MaxListeners
+
+// MaxUnacked is how many deliveries of a single Take stream can wait
+// for acknowledgement, further takes are rejected until some are acknowledged
+const MaxUnacked = 1024
+
+var _ api.MailboxServer = (*Server)(nil)
+
+func NewServer(rack *mailbox.Rack, opts ...Option) *Server {
+	s := &Server{rack: rack}
+	for _, o := range opts {
+		o(s)
+	}
+	return s
+}
+
+// Register adds the Mailbox service for rack to s, see Server.Register
+// to serve a Server which requires tokens
+func Register(s grpc.ServiceRegistrar, rack *mailbox.Rack) {
+	NewServer(rack).Register(s)
+}
+
+// Register adds the Mailbox service to r
+func (s *Server) Register(r grpc.ServiceRegistrar) {
+	api.RegisterMailboxServer(r, s)
+}
+
+func (s *Server) Deliver(ctx context.Context, m *api.MailboxMessage) (*api.Empty, error) {
+	msg, err := fromMessage(m)
+	if err != nil {
+		return nil, status.Error(codes.InvalidArgument, err.Error())
+	}
+	capability, err := s.authorize(ctx, msg.To.Node, mailboxapi.PermWrite)
+	if err != nil {
+		return nil, err
+	}
+	if err := s.rack.Deliver(mailboxapi.WithSender(ctx, capability), msg); err != nil {
+		return nil, statusError(err)
+	}
+	return &api.Empty{}, nil
+}
+
+func (s *Server) Subscribe(req *api.SubscribeRequest, stream grpc.ServerStreamingServer[api.MailboxMessage]) error {
+	addr, err := fromAddress(req.Address)
+	if err != nil {
+		return status.Error(codes.InvalidArgument, err.Error())
+	}
+	ctx := stream.Context()
+	if _, err := s.authorize(ctx, addr.Node, mailboxapi.PermRead); err != nil {
+		return err
+	}
+	for {
+		msg, lease, err := s.rack.TakeLease(ctx, addr)
+		if err != nil {
+			return statusError(err)
+		}
+		if err := stream.Send(toMessage(msg)); err != nil {
+			// the lease will expire and the message will be delivered again
+			return err
+		}
+		if err := s.rack.Ack(context.WithoutCancel(ctx), addr.Node, lease); err != nil {
+			slog.ErrorContext(ctx, "Error acknowledging message for inbox", "inbox", addr.Node, "error", err, "messageId", msg.ID)
+		}
+	}
+}
+
+func (s *Server) Take(stream grpc.BidiStreamingServer[api.TakeRequest, api.TakeResponse]) error {
+	ctx, cancel := context.WithCancel(stream.Context())
+	defer cancel()
+
+	reqs := make(chan *api.TakeRequest)
+	recvErr := make(chan error, 1)
+	go func() {
+		for {
+			req, err := stream.Recv()
+			if err != nil {
+				recvErr <- err
+				return
+			}
+			select {
+			case reqs <- req:
+			case <-ctx.Done():
+				return
+			}
+		}
+	}()
+
+	type delivery struct {
+		msg   *mailbox.Message
+		lease uuid.UUID
+	}
+	// takes wait for messages in their own goroutine, so acks are
+	// handled while the client waits for the next message
+	out := make(chan delivery)
+	failed := make(chan error, 1)
+	pending := 0
+	// leases maps the leases handed out by this stream to their inbox
+	leases := map[uuid.UUID]uuid.UUID{}
+	take := func(addr mailbox.Address) {
+		msg, lease, err := s.rack.TakeLease(ctx, addr)
+		if err != nil {
+			if ctx.Err() == nil {
+				select {
+				case failed <- err:
+				default:
+				}
+			}
+			return
+		}
+		select {
+		case out <- delivery{msg: msg, lease: lease}:
+		case <-ctx.Done():
+			// the lease will expire and the message will be delivered again
+		}
+	}
+
+	for {
+		select {
+		case <-ctx.Done():
+			return status.FromContextError(ctx.Err()).Err()
+		case err := <-recvErr:
+			if errors.Is(err, io.EOF) {
+				return nil
+			}
+			return err
+		case err := <-failed:
+			return statusError(err)
+		case d := <-out:
+			pending--
+			leases[d.lease] = d.msg.To.Node
+			res := &api.TakeResponse{Response: &api.TakeResponse_Delivery{Delivery: &api.Delivery{Message: toMessage(d.msg), Lease: d.lease[:]}}}
+			if err := stream.Send(res); err != nil {
+				return err
+			}
+		case req := <-reqs:
+			switch r := req.Request.(type) {
+			case *api.TakeRequest_Take:
+				addr, err := fromAddress(r.Take)
+				if err != nil {
+					return status.Error(codes.InvalidArgument, err.Error())
+				}
+				if _, err := s.authorize(ctx, addr.Node, mailboxapi.PermRead); err != nil {
+					return err
+				}
+				if pending >= MaxPendingTakes {
+					return status.Errorf(codes.ResourceExhausted, "more than %v pending takes", MaxPendingTakes)
+				} else if pending+len(leases) >= MaxUnacked {
+					return status.Errorf(codes.ResourceExhausted, "more than %v unacknowledged deliveries", MaxUnacked)
+				}
+				pending++
+				go take(addr)
+			case *api.TakeRequest_Ack:
+				lease, err := fromUUID(r.Ack)
+				if err != nil {
+					return status.Error(codes.InvalidArgument, err.Error())
+				}
+				// leases of other streams are not found
+				inbox, found := leases[lease]
+				err = mailbox.ErrLeaseNotFound
+				if found {
+					if _, err := s.authorize(ctx, inbox, mailboxapi.PermRead); err != nil {
+						return err
+					}
+					delete(leases, lease)
+					err = s.rack.Ack(ctx, inbox, lease)
+				}
+				if err != nil && !errors.Is(err, mailbox.ErrLeaseNotFound) {
+					return statusError(err)
+				}
+				res := &api.TakeResponse{Response: &api.TakeResponse_Ack{Ack: &api.AckResult{Lease: r.Ack, Found: err == nil}}}
+				if err := stream.Send(res); err != nil {
+					return err
+				}
+			default:
+				return status.Error(codes.InvalidArgument, "empty take request")
+			}
+		}
+	}
+}
+
+// statusError maps rack and token errors to gRPC status codes, see mailbox/api.Classify
+func statusError(err error) error {
+	switch mailboxapi.Classify(err) {
+	case mailboxapi.KindInvalid:
+		return status.Error(codes.InvalidArgument, err.Error())
+	case mailboxapi.KindUnauthenticated:
+		return status.Error(codes.Unauthenticated, err.Error())
+	case mailboxapi.KindForbidden:
+		return status.Error(codes.PermissionDenied, err.Error())
+	case mailboxapi.KindNotFound:
+		return status.Error(codes.NotFound, err.Error())
+	case mailboxapi.KindRateLimited:
+		st := status.New(codes.ResourceExhausted, err.Error())
+		var limited *mailbox.RateLimitError
+		if errors.As(err, &limited) {
+			if detailed, derr := st.WithDetails(&errdetails.RetryInfo{RetryDelay: durationpb.New(limited.RetryAfter)}); derr == nil {
+				st = detailed
+			}
+		}
+		return st.Err()
+	case mailboxapi.KindRackFull:
+		return status.Error(codes.ResourceExhausted, err.Error())
+	case mailboxapi.KindUnavailable:
+		return status.Error(codes.Unavailable, err.Error())
+	case mailboxapi.KindCanceled:
+		return status.FromContextError(err).Err()
+	default:
+		return status.Error(codes.Internal, err.Error())
+	}
+}
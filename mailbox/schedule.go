@@ -0,0 +1,156 @@
+package mailbox
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"slices"
+	"time"
+
+	"github.com/google/uuid"
+)
+
+type (
+	cancellation struct {
+		inbox  uuid.UUID
+		id     uuid.UUID
+		result chan error
+	}
+)
+
+// DeliverAfterHeader keeps a message invisible to consumers until the given time,
+// the value must be a RFC3339 timestamp (see time.RFC3339Nano).
+//
+// Scheduled messages count towards the rack and inbox limits (see WithRetention
+// and WithInboxDepth), the overflow policy applies when they arrive but they are
+// never evicted to make room for other messages. Their TTL starts when they
+// become visible. Messages due after the schedule horizon (see WithScheduleHorizon)
+// are rejected with ErrInvalidDeliverAfter.
+const DeliverAfterHeader = "Mailbox-Deliver-After"
+
+var (
+	ErrInvalidDeliverAfter = errors.New("invalid deliver after header")
+	ErrNotScheduled        = errors.New("message not scheduled or already visible")
+)
+
+// WithScheduleHorizon sets how far ahead of their arrival messages can be
+// scheduled with DeliverAfterHeader, defaults to 24 hours
+func WithScheduleHorizon(d time.Duration) Option {
+	return func(r *Rack) {
+		r.horizon = d
+	}
+}
+
+// DeliverAfter sets DeliverAfterHeader on msg
+func DeliverAfter(msg *Message, t time.Time) {
+	if msg.Headers == nil {
+		msg.Headers = map[string][]string{}
+	}
+	msg.Headers[DeliverAfterHeader] = []string{t.Format(time.RFC3339Nano)}
+}
+
+// Cancel removes scheduled messages with the given id, sent to any process
+// of inbox, before they become visible. Returns ErrNotScheduled if no such
+// message is waiting.
+//
+// Messages forwarded to another rack (see Registry) must be cancelled there.
+func (r *Rack) Cancel(ctx context.Context, inbox, id uuid.UUID) error {
+	c := cancellation{inbox: inbox, id: id, result: make(chan error, 1)}
+	select {
+	case r.cancels <- c:
+	case <-r.closed:
+		return ErrRackClosed
+	case <-ctx.Done():
+		return ctx.Err()
+	}
+	select {
+	case err := <-c.result:
+		return err
+	case <-r.closed:
+		return ErrRackClosed
+	case <-ctx.Done():
+		return ctx.Err()
+	}
+}
+
+// dueAt returns when msg should become visible, the zero time
+// means it is visible as soon as it arrives
+func dueAt(msg *Message) (time.Time, error) {
+	v := msg.Headers[DeliverAfterHeader]
+	if len(v) == 0 {
+		return time.Time{}, nil
+	}
+	t, err := time.Parse(time.RFC3339Nano, v[0])
+	if err != nil {
+		return time.Time{}, fmt.Errorf("%w: %q", ErrInvalidDeliverAfter, v[0])
+	}
+	return t, nil
+}
+
+// schedule keeps e until it is due, ordered by due time
+func (l *rackLoop) schedule(e entry) error {
+	if ok, err := l.admit(e); !ok {
+		return err
+	}
+	idx, _ := slices.BinarySearchFunc(l.scheduled, e.due, func(s entry, due time.Time) int {
+		return s.due.Compare(due)
+	})
+	l.scheduled = slices.Insert(l.scheduled, idx, e)
+	if idx == 0 {
+		l.wakeup.Reset(time.Until(e.due))
+	}
+	return nil
+}
+
+// release makes every scheduled entry which is due at now visible
+func (l *rackLoop) release(now time.Time) {
+	n := 0
+	for _, e := range l.scheduled {
+		if e.due.After(now) {
+			break
+		}
+		n++
+	}
+	due := l.scheduled[:n]
+	l.scheduled = slices.Clone(l.scheduled[n:])
+	if len(l.scheduled) > 0 {
+		l.wakeup.Reset(time.Until(l.scheduled[0].due))
+	}
+	for _, e := range due {
+		// nobody waits for the result, messages which cannot be parked
+		// (see RejectNew) are evicted instead
+		if err := l.enqueue(e); err != nil {
+			l.metrics.add(l.metrics.evicted)
+			l.deadLetter(e, ReasonEvicted)
+		}
+	}
+}
+
+// scheduledFor returns how many scheduled messages are addressed to inbox
+func (l *rackLoop) scheduledFor(inbox uuid.UUID) int {
+	n := 0
+	for _, e := range l.scheduled {
+		if e.msg.To.Node == inbox {
+			n++
+		}
+	}
+	return n
+}
+
+// cancel removes every scheduled entry for the given message id
+// which is addressed to inbox
+func (l *rackLoop) cancel(inbox, id uuid.UUID) error {
+	found := false
+	l.scheduled = slices.DeleteFunc(l.scheduled, func(e entry) bool {
+		if e.msg.ID != id || e.msg.To.Node != inbox {
+			return false
+		}
+		found = true
+		l.forget(e)
+		return true
+	})
+	if !found {
+		return ErrNotScheduled
+	}
+	return nil
+}
@@ -0,0 +1,62 @@
+package mailbox
+
+import (
+	"context"
+	"errors"
+	"maps"
+	"slices"
+
+	"github.com/google/uuid"
+)
+
+// TopicHeader is added to each copy of a message delivered to a topic,
+// it contains the topic the message was originally sent to
+const TopicHeader = "Mailbox-Topic"
+
+// Join subscribes addr to topic, after that point each message sent
+// to the topic is copied to addr.
+//
+// An inbox works as a topic while it has at least one subscriber, messages
+// sent to a topic without subscribers are handled like any other message.
+func (r *Rack) Join(topic uuid.UUID, addr Address) {
+	r.topics.Update(topic, func(subs []Address, _ bool) ([]Address, bool) {
+		if slices.Contains(subs, addr) {
+			return subs, true
+		}
+		// copy on write, Deliver reads the slice without holding the lock
+		return append(slices.Clip(subs), addr), true
+	})
+}
+
+// Leave removes addr from the subscribers of topic
+func (r *Rack) Leave(topic uuid.UUID, addr Address) {
+	r.topics.Update(topic, func(subs []Address, _ bool) ([]Address, bool) {
+		subs = slices.DeleteFunc(slices.Clone(subs), func(a Address) bool { return a == addr })
+		return subs, len(subs) > 0
+	})
+}
+
+// fanOut delivers a copy of msg to each subscriber of topic, returns false
+// if msg.To is not a topic
+func (r *Rack) fanOut(ctx context.Context, msg *Message) (bool, error) {
+	subs, found := r.topics.Get(msg.To.Node)
+	if !found {
+		return false, nil
+	}
+	var errs []error
+	for _, addr := range subs {
+		cp := *msg
+		cp.To = addr
+		cp.Headers = maps.Clone(msg.Headers)
+		if cp.Headers == nil {
+			cp.Headers = map[string][]string{}
+		}
+		cp.Headers[TopicHeader] = []string{msg.To.Node.String()}
+		if forwarded, err := r.forward(ctx, &cp); forwarded {
+			errs = append(errs, err)
+			continue
+		}
+		errs = append(errs, r.accept(ctx, &cp))
+	}
+	return true, errors.Join(errs...)
+}
@@ -0,0 +1,98 @@
+package mailbox
+
+import (
+	"context"
+	"maps"
+	"net/http"
+	"time"
+
+	"go.opentelemetry.io/otel"
+	"go.opentelemetry.io/otel/attribute"
+	"go.opentelemetry.io/otel/codes"
+	"go.opentelemetry.io/otel/propagation"
+	"go.opentelemetry.io/otel/trace"
+)
+
+const tracerName = "github.com/andrebq/mixtape/mailbox"
+
+// messages carry W3C trace context (traceparent and tracestate) in their headers
+var tracePropagator = propagation.TraceContext{}
+
+// WithTracerProvider reports rack spans to tp, by default the global
+// provider (otel.GetTracerProvider) is used
+func WithTracerProvider(tp trace.TracerProvider) Option {
+	return func(r *Rack) {
+		r.tracerProvider = tp
+	}
+}
+
+// InjectTraceContext stores the span context of ctx in a copy of the headers of msg,
+// so consumers can continue the trace (see ExtractTraceContext). The original map is
+// not modified, callers might still use it (eg.: to retry a delivery)
+func InjectTraceContext(ctx context.Context, msg *Message) {
+	if !trace.SpanContextFromContext(ctx).IsValid() {
+		return
+	}
+	headers := maps.Clone(msg.Headers)
+	if headers == nil {
+		headers = map[string][]string{}
+	}
+	tracePropagator.Inject(ctx, propagation.HeaderCarrier(http.Header(headers)))
+	msg.Headers = headers
+}
+
+// ExtractTraceContext returns a copy of ctx with the span context stored in the headers of msg,
+// if there is one
+func ExtractTraceContext(ctx context.Context, msg *Message) context.Context {
+	return tracePropagator.Extract(ctx, propagation.HeaderCarrier(http.Header(msg.Headers)))
+}
+
+func newTracer(tp trace.TracerProvider) trace.Tracer {
+	if tp == nil {
+		tp = otel.GetTracerProvider()
+	}
+	return tp.Tracer(tracerName)
+}
+
+func messageAttributes(msg *Message) trace.SpanStartEventOption {
+	return trace.WithAttributes(
+		attribute.String("messaging.system", "mailbox"),
+		attribute.String("messaging.message.id", msg.ID.String()),
+		attribute.String("messaging.destination.name", msg.To.String()),
+	)
+}
+
+// startDeliver starts the span which covers Rack.Deliver, messages posted without
+// a span in ctx continue the trace stored in their headers
+func (r *Rack) startDeliver(ctx context.Context, msg *Message) (context.Context, trace.Span) {
+	if !trace.SpanContextFromContext(ctx).IsValid() {
+		ctx = ExtractTraceContext(ctx, msg)
+	}
+	return r.tracer.Start(ctx, "mailbox.deliver", trace.WithSpanKind(trace.SpanKindProducer), messageAttributes(msg))
+}
+
+// traceTake records a span for a message handed to a consumer
+// which started waiting at start
+func (r *Rack) traceTake(ctx context.Context, msg *Message, start time.Time) {
+	opts := []trace.SpanStartOption{trace.WithSpanKind(trace.SpanKindConsumer), trace.WithTimestamp(start), messageAttributes(msg)}
+	if sc := trace.SpanContextFromContext(ctx); sc.IsValid() {
+		opts = append(opts, trace.WithLinks(trace.Link{SpanContext: sc}))
+	}
+	_, span := r.tracer.Start(ExtractTraceContext(context.Background(), msg), "mailbox.take", opts...)
+	span.End()
+}
+
+// tracePark records a span for a message which was parked
+func (r *Rack) tracePark(msg *Message) {
+	_, span := r.tracer.Start(ExtractTraceContext(context.Background(), msg), "mailbox.park", messageAttributes(msg))
+	span.End()
+}
+
+// endSpan ends span recording err, if any
+func endSpan(span trace.Span, err error) {
+	if err != nil {
+		span.RecordError(err)
+		span.SetStatus(codes.Error, err.Error())
+	}
+	span.End()
+}
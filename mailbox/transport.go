@@ -0,0 +1,39 @@
+package mailbox
+
+import (
+	"context"
+	"iter"
+)
+
+type (
+	// Transport is the client side of a rack, application code which depends on it
+	// can use an in-process Rack or a remote one (see the api package) without changes.
+	Transport interface {
+		// Deliver sends msg to its inbox
+		Deliver(ctx context.Context, msg *Message) error
+		// TakeAddress waits until a message for addr arrives
+		TakeAddress(ctx context.Context, addr Address) (*Message, error)
+		// Subscribe returns every message sent to addr, see Rack.Subscribe
+		Subscribe(ctx context.Context, addr Address) iter.Seq2[*Message, error]
+	}
+)
+
+var _ Transport = (*Rack)(nil)
+
+// Subscribe takes messages for addr until the consumer breaks out of the loop,
+// or an error happens (including ctx being done), in which case the last value
+// contains the error.
+func (r *Rack) Subscribe(ctx context.Context, addr Address) iter.Seq2[*Message, error] {
+	return func(yield func(*Message, error) bool) {
+		for {
+			msg, err := r.TakeAddress(ctx, addr)
+			if err != nil {
+				yield(nil, err)
+				return
+			}
+			if !yield(msg, nil) {
+				return
+			}
+		}
+	}
+}
@@ -0,0 +1,78 @@
+package mailbox
+
+import (
+	"iter"
+	"slices"
+
+	"github.com/google/uuid"
+)
+
+type (
+	// waitlist holds consumers waiting for messages, each inbox keeps
+	// its own FIFO queue so consumers of the same inbox take turns
+	waitlist struct {
+		inboxes map[uuid.UUID][]consumer
+		size    int
+	}
+)
+
+func newWaitlist() *waitlist {
+	return &waitlist{inboxes: map[uuid.UUID][]consumer{}}
+}
+
+func (w *waitlist) len() int { return w.size }
+
+// add places c at the end of its inbox queue
+func (w *waitlist) add(c consumer) {
+	inbox := c.addr.Node
+	w.inboxes[inbox] = append(w.inboxes[inbox], c)
+	w.size++
+}
+
+// remove drops the consumer which owns output, if it is still waiting
+func (w *waitlist) remove(c consumer) {
+	inbox := c.addr.Node
+	queue := w.inboxes[inbox]
+	idx := slices.IndexFunc(queue, func(v consumer) bool { return v.output == c.output })
+	if idx < 0 {
+		return
+	}
+	w.take(inbox, idx)
+}
+
+// next removes and returns the consumer which waited the longest
+// for messages sent to the given address
+func (w *waitlist) next(to Address) (consumer, bool) {
+	queue := w.inboxes[to.Node]
+	idx := slices.IndexFunc(queue, func(c consumer) bool { return c.addr.routes(to) })
+	if idx < 0 {
+		return consumer{}, false
+	}
+	return w.take(to.Node, idx), true
+}
+
+func (w *waitlist) take(inbox uuid.UUID, idx int) consumer {
+	queue := w.inboxes[inbox]
+	c := queue[idx]
+	queue = slices.Delete(queue, idx, idx+1)
+	if len(queue) == 0 {
+		delete(w.inboxes, inbox)
+	} else {
+		w.inboxes[inbox] = queue
+	}
+	w.size--
+	return c
+}
+
+// all returns every waiting consumer
+func (w *waitlist) all() iter.Seq[consumer] {
+	return func(yield func(consumer) bool) {
+		for _, queue := range w.inboxes {
+			for _, c := range queue {
+				if !yield(c) {
+					return
+				}
+			}
+		}
+	}
+}
@@ -7,6 +7,8 @@ import (
 	"net/http"
 
 	"github.com/andrebq/mixtape/api"
+	"github.com/andrebq/mixtape/mailbox"
+	"github.com/andrebq/mixtape/mailbox/rpc"
 	"google.golang.org/grpc"
 )
 
@@ -14,8 +16,27 @@ type (
 	TaskManagerServer struct {
 		api.UnsafeTaskManagerServer
 	}
+
+	// Option configures the server returned by Handler
+	Option func(*config)
+
+	config struct {
+		serverOpts []grpc.ServerOption
+		services   []func(grpc.ServiceRegistrar)
+	}
 )
 
+// WithMailbox also serves rack with the Mailbox service, so runners can
+// exchange messages using the same connection. Options such as
+// rpc.WithTokenKey apply to the Mailbox service only.
+func WithMailbox(rack *mailbox.Rack, opts ...rpc.Option) Option {
+	return func(c *config) {
+		mb := rpc.NewServer(rack, opts...)
+		c.serverOpts = append(c.serverOpts, mb.ServerOptions()...)
+		c.services = append(c.services, mb.Register)
+	}
+}
+
 func (s *TaskManagerServer) RegisterSupervisor(ctx context.Context, req *api.SupervisorStats) (*api.SupervisorConfig, error) {
 	slog.InfoContext(ctx, "RegisterSupervisor called")
 	return &api.SupervisorConfig{}, nil
@@ -45,8 +66,15 @@ func GenAgentToken(name string, minLabels []string) (string, error) {
 	return "", errors.ErrUnsupported
 }
 
-func Handler() (http.Handler, error) {
-	server := grpc.NewServer()
+func Handler(opts ...Option) (http.Handler, error) {
+	cfg := &config{}
+	for _, o := range opts {
+		o(cfg)
+	}
+	server := grpc.NewServer(cfg.serverOpts...)
 	api.RegisterTaskManagerServer(server, &TaskManagerServer{})
+	for _, register := range cfg.services {
+		register(server)
+	}
 	return server, nil
 }